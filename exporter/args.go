@@ -0,0 +1,87 @@
+package exporter
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// runtime values a query argument can take
+const (
+	argLastRun  = "last_run" // start of the previous successful run of the query on the connection
+	argNow      = "now"      // start of the current run
+	argInterval = "interval" // interval of the job in seconds
+)
+
+// QueryArg is a bind variable of a query, referenced as ? in the SQL text.
+// Exactly one of the fields is set.
+type QueryArg struct {
+	Value   interface{} `yaml:"value,omitempty"`   // static value
+	Env     string      `yaml:"env,omitempty"`     // environment variable, read on every run
+	Runtime string      `yaml:"runtime,omitempty"` // last_run, now, interval or watermark
+}
+
+// check reports the problem of the argument, if any
+func (a *QueryArg) check() string {
+	set := 0
+	for _, ok := range []bool{a.Value != nil, a.Env != "", a.Runtime != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return "exactly one of value, env and runtime must be set"
+	}
+	switch a.Runtime {
+	case "", argLastRun, argNow, argInterval, argWatermark:
+	default:
+		return fmt.Sprintf("runtime must be last_run, now, interval or watermark, not %q", a.Runtime)
+	}
+	return ""
+}
+
+// args returns the values of the arguments of q for a run on conn that
+// started at now
+func (q *Query) args(conn *connection, now time.Time) ([]interface{}, error) {
+	args := make([]interface{}, 0, len(q.Args))
+	for _, a := range q.Args {
+		switch {
+		case a.Env != "":
+			v, ok := os.LookupEnv(a.Env)
+			if !ok {
+				return nil, fmt.Errorf("environment variable %s is not set", a.Env)
+			}
+			args = append(args, v)
+		case a.Runtime == argLastRun:
+			q.Lock()
+			last, ok := q.lastRun[conn]
+			q.Unlock()
+			if !ok {
+				// the first run covers one interval
+				last = now.Add(-q.interval)
+			}
+			args = append(args, last)
+		case a.Runtime == argNow:
+			args = append(args, now)
+		case a.Runtime == argInterval:
+			args = append(args, q.interval.Seconds())
+		case a.Runtime == argWatermark:
+			args = append(args, q.watermark(conn))
+		default:
+			args = append(args, a.Value)
+		}
+	}
+	return args, nil
+}
+
+// bind rewrites the ? placeholders of the query to the ones of the driver,
+// e.g. $1 for postgres. Queries without arguments are left as they are, as
+// ? is an operator in some dialects.
+func (q *Query) bind(query string, driver string) string {
+	if len(q.Args) == 0 {
+		return query
+	}
+	return sqlx.Rebind(sqlx.BindType(driver), query)
+}
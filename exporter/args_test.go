@@ -0,0 +1,112 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryArgs(t *testing.T) {
+	t.Setenv("SQL_EXPORTER_TEST_SCHEMA", "billing")
+	q := &Query{
+		Args: []QueryArg{
+			{Value: 10},
+			{Env: "SQL_EXPORTER_TEST_SCHEMA"},
+			{Runtime: argLastRun},
+			{Runtime: argNow},
+			{Runtime: argInterval},
+		},
+		interval: time.Minute,
+		lastRun:  make(map[*connection]time.Time),
+	}
+	conn := &connection{}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	args, err := q.args(conn, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first run covers one interval
+	want := []interface{}{10, "billing", now.Add(-time.Minute), now, 60.0}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("argument %d: got %v, want %v", i, args[i], want[i])
+		}
+	}
+
+	q.lastRun[conn] = now.Add(-time.Hour)
+	if args, _ := q.args(conn, now); args[2] != now.Add(-time.Hour) {
+		t.Errorf("got last run %v, want %v", args[2], now.Add(-time.Hour))
+	}
+
+	q.Args = []QueryArg{{Env: "SQL_EXPORTER_TEST_MISSING"}}
+	if _, err := q.args(conn, now); err == nil {
+		t.Error("missing environment variable was bound")
+	}
+}
+
+func TestQueryArgCheck(t *testing.T) {
+	for _, tc := range []struct {
+		arg  QueryArg
+		want string
+	}{
+		{QueryArg{Value: "x"}, ""},
+		{QueryArg{Runtime: argWatermark}, ""},
+		{QueryArg{}, "exactly one of value, env and runtime must be set"},
+		{QueryArg{Value: 1, Env: "X"}, "exactly one of value, env and runtime must be set"},
+		{QueryArg{Runtime: "yesterday"}, `runtime must be last_run, now, interval or watermark, not "yesterday"`},
+	} {
+		if got := tc.arg.check(); got != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.arg, got, tc.want)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	query := "SELECT count(*) AS v FROM t WHERE a > ? AND b = ?"
+	for _, tc := range []struct {
+		driver string
+		want   string
+	}{
+		{"postgres", "SELECT count(*) AS v FROM t WHERE a > $1 AND b = $2"},
+		{"pgx", "SELECT count(*) AS v FROM t WHERE a > $1 AND b = $2"},
+		{"sqlserver", "SELECT count(*) AS v FROM t WHERE a > @p1 AND b = @p2"},
+		{"mysql", query},
+		{"sqlite", query},
+		{"clickhouse", query},
+	} {
+		q := &Query{Args: []QueryArg{{Value: 1}, {Value: 2}}}
+		if got := q.bind(query, tc.driver); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.driver, got, tc.want)
+		}
+	}
+
+	// ? is an operator of postgres jsonb
+	q := &Query{}
+	if got := q.bind("SELECT count(*) FROM t WHERE doc ? 'key'", "postgres"); got != "SELECT count(*) FROM t WHERE doc ? 'key'" {
+		t.Errorf("query without arguments was rebound to %q", got)
+	}
+}
+
+func TestRunWithArgs(t *testing.T) {
+	t.Setenv("SQL_EXPORTER_TEST_LIMIT", "2")
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - name: q
+    help: h
+    values: [v]
+    query: SELECT ? + ? AS v
+    args: [{value: 1}, {env: SQL_EXPORTER_TEST_LIMIT}]
+`)
+	if err := exp.jobs[0].runOnce(0); err != nil {
+		t.Fatal(err)
+	}
+	gatherAndCompare(t, exp, dir, `
+# HELP sql_q h
+# TYPE sql_q gauge
+sql_q{col="v",database="DIR/x.db",driver="sqlite",host="DIR/x.db",sql_job="a",user=""} 3
+`, "sql_q")
+}
@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// arrayColumns returns the array columns of the current result set of pgx
+// rows. The database/sql adapter of pgx passes arrays in their text form,
+// e.g. {a,"b c",NULL}, they are decoded by decodeArrays.
+func arrayColumns(rows *sqlx.Rows, driver string) (map[string]bool, error) {
+	if driver != "pgx" {
+		return nil, nil
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	var arrays map[string]bool
+	for _, t := range types {
+		// the element type prefixed with an underscore, e.g. _INT4
+		if strings.HasPrefix(t.DatabaseTypeName(), "_") {
+			if arrays == nil {
+				arrays = make(map[string]bool)
+			}
+			arrays[t.Name()] = true
+		}
+	}
+	return arrays, nil
+}
+
+// decodeArrays replaces the text form of the array columns of the row by
+// their elements
+func decodeArrays(res map[string]interface{}, arrays map[string]bool) error {
+	for name := range arrays {
+		s, ok := res[name].(string)
+		if !ok {
+			// NULL
+			continue
+		}
+		elems, err := parseArray(s)
+		if err != nil {
+			return fmt.Errorf("Column '%s': %v", name, err)
+		}
+		res[name] = elems
+	}
+	return nil
+}
+
+// parseArray parses the text form of a PostgreSQL array. The elements of
+// multi-dimensional arrays are flattened, NULL elements are nil, all others
+// strings.
+func parseArray(s string) ([]interface{}, error) {
+	// the bounds are only given if they don't start at 1, e.g. [0:1]={a,b}
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid array %q", s)
+		}
+		s = s[i+1:]
+	}
+	if !strings.HasPrefix(s, "{") {
+		return nil, fmt.Errorf("invalid array %q", s)
+	}
+	elems := []interface{}{}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("invalid array %q", s)
+			}
+		case ',', ' ':
+		case '"':
+			var b strings.Builder
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+				if i < len(s) {
+					b.WriteByte(s[i])
+				}
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("invalid array %q", s)
+			}
+			elems = append(elems, b.String())
+		default:
+			j := i
+			for j < len(s) && s[j] != ',' && s[j] != '}' {
+				j++
+			}
+			if elem := strings.TrimSpace(s[i:j]); elem == "NULL" {
+				elems = append(elems, nil)
+			} else {
+				elems = append(elems, elem)
+			}
+			i = j - 1
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("invalid array %q", s)
+	}
+	return elems, nil
+}
+
+// joinArray returns the label value of an array, its elements separated by
+// commas, NULL elements are empty
+func joinArray(elems []interface{}) string {
+	parts := make([]string, len(elems))
+	for i, e := range elems {
+		if e != nil {
+			parts[i] = fmt.Sprint(e)
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestParseArray(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want []interface{}
+	}{
+		{`{}`, []interface{}{}},
+		{`{1,2,3}`, []interface{}{"1", "2", "3"}},
+		{`{a,"b c",NULL,"NULL"}`, []interface{}{"a", "b c", nil, "NULL"}},
+		{`{"a \"quoted\" \\ text","x,y"}`, []interface{}{`a "quoted" \ text`, "x,y"}},
+		{`{{1,2},{3,4}}`, []interface{}{"1", "2", "3", "4"}},
+		{`[0:1]={a,b}`, []interface{}{"a", "b"}},
+	} {
+		got, err := parseArray(tc.text)
+		if err != nil {
+			t.Errorf("%s: %v", tc.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.text, got, tc.want)
+		}
+	}
+	for _, text := range []string{`1,2`, `{1,2`, `{"a}`, `{1}}`, `[0:1]`} {
+		if _, err := parseArray(text); err == nil {
+			t.Errorf("%s: invalid array was parsed", text)
+		}
+	}
+}
+
+// arrayConnector connects to a database returning arrays in their text form
+// with the type names of pgx
+type arrayConnector struct{}
+
+func (arrayConnector) Connect(context.Context) (driver.Conn, error) { return arrayConn{}, nil }
+func (arrayConnector) Driver() driver.Driver                        { return nil }
+
+type arrayConn struct{}
+
+func (arrayConn) Prepare(string) (driver.Stmt, error) { return nil, io.EOF }
+func (arrayConn) Close() error                        { return nil }
+func (arrayConn) Begin() (driver.Tx, error)           { return nil, io.EOF }
+
+func (arrayConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &arrayRows{}, nil
+}
+
+type arrayRows struct {
+	read bool
+}
+
+func (r *arrayRows) Columns() []string { return []string{"names", "ids", "n"} }
+func (r *arrayRows) Close() error      { return nil }
+
+func (r *arrayRows) ColumnTypeDatabaseTypeName(i int) string {
+	return []string{"_TEXT", "_INT4", "INT8"}[i]
+}
+
+func (r *arrayRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	copy(dest, []driver.Value{`{a,"b c",NULL}`, "{1,2}", int64(2)})
+	r.read = true
+	return nil
+}
+
+func TestArrays(t *testing.T) {
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  read_only: false
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - {name: labels, help: h, labels: [names], values: [n], query: SELECT 1}
+  - {name: values, help: h, values: [ids], query: SELECT 1}
+`)
+	j := exp.jobs[0]
+	conn := &connection{conn: sqlx.NewDb(sql.OpenDB(arrayConnector{}), "pgx"), driver: "pgx", database: "db"}
+	j.connsMu.Lock()
+	j.conns = []*connection{conn}
+	j.connsMu.Unlock()
+	ctx := ContextWithTracer(context.Background(), *j.tracer)
+	if err := j.Queries[0].Run(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	// arrays can't be values, the row is skipped
+	if err := j.Queries[1].Run(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Queries[1].value(map[string]interface{}{"ids": []interface{}{"1", "2"}}, "ids"); err == nil ||
+		err.Error() != "Column 'ids' is an array, arrays can only be labels" {
+		t.Errorf("got error %v", err)
+	}
+	gatherAndCompare(t, exp, dir, `
+# HELP sql_labels h
+# TYPE sql_labels gauge
+sql_labels{col="n",database="db",driver="pgx",host="",names="a,b c,",sql_job="a",user=""} 2
+`, "sql_labels", "sql_values")
+}
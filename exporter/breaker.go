@@ -0,0 +1,151 @@
+package exporter
+
+import (
+	"time"
+)
+
+// states of the circuit breaker of a connection, exposed as
+// sql_exporter_circuit_breaker_state
+const (
+	breakerClosed   = 0 // queries run
+	breakerOpen     = 1 // queries are skipped until the open time passed
+	breakerHalfOpen = 2 // a single run probes the connection
+)
+
+var breakerStates = map[int]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half-open",
+}
+
+// defaultBreakerFailures is the number of failed runs that open a breaker
+const defaultBreakerFailures = 5
+
+// CircuitBreaker stops running the queries of a connection that failed
+// repeatedly, so that a database that is down isn't hammered. Once the
+// breaker is open, a single run probes the connection after the open
+// duration. If the probe fails, the open duration doubles.
+type CircuitBreaker struct {
+	Failures        int           `yaml:"failures,omitempty"`          // consecutive failed runs that open the breaker, 5 if empty
+	OpenDuration    time.Duration `yaml:"open_duration,omitempty"`     // time until the first probe, the job interval if empty
+	MaxOpenDuration time.Duration `yaml:"max_open_duration,omitempty"` // limit of the doubled open duration, 32 times open_duration if empty
+}
+
+func (cb *CircuitBreaker) failures() int {
+	if cb == nil || cb.Failures <= 0 {
+		return defaultBreakerFailures
+	}
+	return cb.Failures
+}
+
+func (cb *CircuitBreaker) openDuration(interval time.Duration) time.Duration {
+	if cb == nil || cb.OpenDuration <= 0 {
+		return interval
+	}
+	return cb.OpenDuration
+}
+
+func (cb *CircuitBreaker) maxOpenDuration(interval time.Duration) time.Duration {
+	if cb == nil || cb.MaxOpenDuration <= 0 {
+		return 32 * cb.openDuration(interval)
+	}
+	return cb.MaxOpenDuration
+}
+
+// breaker is the circuit breaker state of a connection, guarded by the mutex
+// of the connection
+type breaker struct {
+	state    int
+	failures int           // consecutive failed runs
+	openFor  time.Duration // current open duration
+	until    time.Time     // end of the open state
+}
+
+// allow reports whether the queries may run on the connection. An open
+// breaker turns half-open once its time passed, letting one run probe the
+// connection.
+func (c *connection) allow(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.breaker.state {
+	case breakerOpen:
+		if now.Before(c.breaker.until) {
+			return false
+		}
+		c.breaker.state = breakerHalfOpen
+	}
+	return true
+}
+
+// succeeded closes the breaker. It returns whether it was not closed.
+func (c *connection) succeeded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	closed := c.breaker.state == breakerClosed
+	c.breaker = breaker{}
+	return !closed
+}
+
+// failed counts a failed run and opens the breaker after too many or a
+// failed probe. It returns whether the breaker opened.
+func (c *connection) failed(job *Job, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cb := job.CircuitBreaker
+	c.breaker.failures++
+	switch {
+	case c.breaker.state == breakerHalfOpen:
+		c.breaker.openFor *= 2
+		if max := cb.maxOpenDuration(job.Interval); c.breaker.openFor > max {
+			c.breaker.openFor = max
+		}
+	case c.breaker.failures >= cb.failures():
+		c.breaker.openFor = cb.openDuration(job.Interval)
+	default:
+		return false
+	}
+	c.breaker.state = breakerOpen
+	c.breaker.until = now.Add(c.breaker.openFor)
+	return true
+}
+
+// breakerState returns the state of the breaker and the time of the next
+// probe if it is open
+func (c *connection) breakerState() (int, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.breaker.state, c.breaker.until
+}
+
+// ConnectionState is the state of a connection shown on the index page
+type ConnectionState struct {
+	Driver   string
+	Host     string
+	Database string
+	Breaker  string
+	Failures int
+	ProbeAt  string // time of the next probe of an open breaker
+}
+
+// ConnectionStates returns the state of the connections of the job
+func (j *Job) ConnectionStates() []ConnectionState {
+	conns := j.connections()
+	states := make([]ConnectionState, 0, len(conns))
+	for _, c := range conns {
+		c.mu.Lock()
+		b := c.breaker
+		c.mu.Unlock()
+		s := ConnectionState{
+			Driver:   c.driver,
+			Host:     c.host,
+			Database: c.database,
+			Breaker:  breakerStates[b.state],
+			Failures: b.failures,
+		}
+		if b.state == breakerOpen {
+			s.ProbeAt = b.until.Format(time.RFC3339)
+		}
+		states = append(states, s)
+	}
+	return states
+}
@@ -0,0 +1,67 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerCountsRuns(t *testing.T) {
+	dir := t.TempDir()
+	// mode=ro doesn't create the missing file, so connecting fails
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/missing.db?mode=ro']
+  circuit_breaker: {failures: 2}
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+`)
+	j := exp.jobs[0]
+	conn := j.connections()[0]
+
+	// a run fails once, however often it's retried
+	j.runOnce(200 * time.Millisecond)
+	if state, _ := conn.breakerState(); state != breakerClosed || conn.breaker.failures != 1 {
+		t.Fatalf("got state %s with %d failures after a run, want closed with 1", breakerStates[state], conn.breaker.failures)
+	}
+	j.runOnce(0)
+	state, until := conn.breakerState()
+	if state != breakerOpen {
+		t.Fatalf("got state %s after two runs, want open", breakerStates[state])
+	}
+
+	// skipped while open, probed once its time passed
+	if conn.allow(until.Add(-time.Second)) {
+		t.Fatal("open breaker allowed a run")
+	}
+	if !conn.allow(until) {
+		t.Fatal("breaker didn't allow a probe")
+	}
+	// a probe is not retried, this would take a minute otherwise
+	j.runOnce(time.Minute)
+	if state, next := conn.breakerState(); state != breakerOpen || time.Until(next) < 2*time.Minute-time.Second {
+		t.Fatalf("got state %s until %v after a failed probe, want open for twice as long", breakerStates[state], next)
+	}
+}
+
+func TestBreakerIgnoresQueryErrors(t *testing.T) {
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  circuit_breaker: {failures: 1}
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT FROM WHERE}
+`)
+	j := exp.jobs[0]
+	conn := j.connections()[0]
+	for i := 0; i < 3; i++ {
+		j.runOnce(0)
+		if state, _ := conn.breakerState(); state != breakerClosed || conn.breaker.failures != 0 {
+			t.Fatalf("got state %s with %d failures after a broken query, want closed", breakerStates[state], conn.breaker.failures)
+		}
+	}
+}
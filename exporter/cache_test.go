@@ -0,0 +1,63 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFresh(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	conn := &connection{}
+	for _, tc := range []struct {
+		name        string
+		minInterval time.Duration
+		age         time.Duration // zero if the query never ran
+		want        bool
+	}{
+		{"no min_interval", 0, time.Second, false},
+		{"never ran", 5 * time.Minute, 0, false},
+		{"young", 5 * time.Minute, time.Minute, true},
+		// a tenth of the job interval, 6s, is allowed for the jitter of
+		// the job runs
+		{"within jitter", 5 * time.Minute, 4*time.Minute + 55*time.Second, false},
+		{"just before jitter", 5 * time.Minute, 4*time.Minute + 53*time.Second, true},
+		{"old", 5 * time.Minute, 10 * time.Minute, false},
+	} {
+		q := &Query{
+			MinInterval: tc.minInterval,
+			interval:    time.Minute,
+			lastRun:     make(map[*connection]time.Time),
+		}
+		if tc.age > 0 {
+			q.lastRun[conn] = now.Add(-tc.age)
+		}
+		if got := q.fresh(conn, now); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - {name: cached, help: h, values: [v], query: 'SELECT 1 AS v', min_interval: 5m}
+  - {name: uncached, help: h, values: [v], query: 'SELECT 1 AS v'}
+`)
+	if err := exp.jobs[0].runOnce(0); err != nil {
+		t.Fatal(err)
+	}
+	// only the query with min_interval exposes the age of its result
+	if n := testutil.CollectAndCount(exp, "sql_query_cache_age_seconds"); n != 1 {
+		t.Fatalf("got %d cache age metrics, want 1", n)
+	}
+	if exp.jobs[0].Queries[1].cacheAgeDesc != nil {
+		t.Error("query without min_interval has a cache age descriptor")
+	}
+}
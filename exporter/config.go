@@ -1,21 +1,135 @@
 package exporter
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
 )
 
 // Read attempts to parse the given config and return a file
-// object
+// object. The path may be a file, a directory or a glob pattern. All
+// matching files and the files they include are merged into one.
+// Unknown fields and semantic problems are reported together as
+// ConfigErrors, which give the file and line of each problem.
 func Read(path string) (File, error) {
 	f := File{}
 
+	paths, err := expandPaths(path, "")
+	if err != nil {
+		return f, err
+	}
+	l := &loader{
+		files: make(map[string]bool),
+	}
+	var errs ConfigErrors
+	for _, p := range paths {
+		if err := l.load(&f, p, &errs); err != nil {
+			return f, err
+		}
+	}
+
+	f.resolveQueries(&errs)
+	f.resolvePacks(&errs)
+	f.resolveTargetLabels()
+	f.validate(&errs)
+	if len(errs) > 0 {
+		return f, errs
+	}
+	return f, nil
+}
+
+// loader merges config files into one
+type loader struct {
+	files map[string]bool // files loaded so far
+}
+
+// load reads the config file at path and the files it includes and merges
+// them into f. Problems with the contents are added to errs, the returned
+// error is only set if a file cannot be read at all.
+func (l *loader) load(f *File, path string, errs *ConfigErrors) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	// a file may be matched by several patterns or include each other
+	if l.files[abs] {
+		return nil
+	}
+	l.files[abs] = true
+
+	part, err := readFile(path, errs)
+	if err != nil {
+		return err
+	}
+	for i, j := range part.Jobs {
+		if j == nil {
+			errs.add(part.src.at(fmt.Sprintf("jobs[%d]", i)), "job is empty")
+			continue
+		}
+		f.Jobs = append(f.Jobs, j)
+	}
+	names := make([]string, 0, len(part.Queries))
+	for name := range part.Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		query := part.Queries[name]
+		if prev, ok := f.queriesSrc[name]; ok {
+			if !reflect.DeepEqual(f.Queries[name], query) {
+				errs.add(part.src.at("queries."+name), "query %q conflicts with its definition at %s", name, prev.at("queries."+name))
+			}
+			continue
+		}
+		if f.Queries == nil {
+			f.Queries = make(QueryLibrary)
+			f.queriesSrc = make(map[string]*source)
+		}
+		f.Queries[name] = query
+		f.queriesSrc[name] = part.src
+	}
+
+	if part.StateFile != "" {
+		if f.StateFile != "" && f.StateFile != part.StateFile {
+			errs.add(part.src.at("state_file"), "state_file %q conflicts with %q set at %s", part.StateFile, f.StateFile, f.stateFileSrc.at("state_file"))
+		} else {
+			f.StateFile, f.stateFileSrc = part.StateFile, part.src
+		}
+	}
+
+	// includes are relative to the including file
+	for i, include := range part.Include {
+		paths, err := expandPaths(include, filepath.Dir(path))
+		if err != nil {
+			errs.add(part.src.at(fmt.Sprintf("include[%d]", i)), "%v", err)
+			continue
+		}
+		for _, p := range paths {
+			if err := l.load(f, p, errs); err != nil {
+				errs.add(part.src.at(fmt.Sprintf("include[%d]", i)), "%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// readFile parses a single config file
+func readFile(path string, errs *ConfigErrors) (*File, error) {
+	f := &File{}
+
 	fh, err := os.Open(path)
 	if err != nil {
 		return f, err
@@ -27,39 +141,189 @@ func Read(path string) (File, error) {
 		return f, err
 	}
 
-	if err := yaml.Unmarshal(buf, &f); err != nil {
-		return f, err
+	// syntax errors prevent any further checks
+	var root yaml.Node
+	if err := yaml.Unmarshal(buf, &root); err != nil {
+		return f, fmt.Errorf("%s: %v", path, err)
+	}
+	f.src = newSource(path, &root)
+
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(f); err != nil && err != io.EOF {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return f, fmt.Errorf("%s: %v", path, err)
+		}
+		// the rest of the file is still decoded
+		errs.typeErrors(path, typeErr)
+	}
+	if f.StateFile != "" && !filepath.IsAbs(f.StateFile) {
+		f.StateFile = filepath.Join(filepath.Dir(path), f.StateFile)
+	}
+	for i, j := range f.Jobs {
+		if j != nil {
+			j.src, j.path = f.src, fmt.Sprintf("jobs[%d]", i)
+			if j.ConnectionsFrom != nil {
+				j.ConnectionsFrom.resolve(filepath.Dir(path))
+			}
+			if j.TLS != nil {
+				j.TLS.resolve(filepath.Dir(path))
+			}
+			for k := range j.Connections {
+				j.Connections[k].resolve(filepath.Dir(path))
+			}
+		}
 	}
 	return f, nil
 }
 
+// expandPaths resolves a file, directory or glob pattern to config files.
+// A relative pattern is resolved against dir. Directories contribute all of
+// their *.yml and *.yaml files.
+func expandPaths(pattern string, dir string) ([]string, error) {
+	if dir != "" && !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config path %q: %v", pattern, err)
+	}
+	if len(matches) == 0 {
+		// let opening the file report a missing file
+		matches = []string{pattern}
+	}
+	var paths []string
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err == nil && fi.IsDir() {
+			files, err := configFiles(m)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, files...)
+			continue
+		}
+		paths = append(paths, m)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no config files found in %q", pattern)
+	}
+	return paths, nil
+}
+
+// configFiles returns the YAML files in dir in lexical order. Hidden files are
+// skipped, e.g. the ..data links of mounted Kubernetes ConfigMaps.
+func configFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext == ".yml" || ext == ".yaml" {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	return files, nil
+}
+
 // File is a collection of jobs
 type File struct {
-	Jobs    []*Job            `yaml:"jobs"`
-	Queries map[string]string `yaml:"queries,omitempty"`
+	Jobs    []*Job       `yaml:"jobs"`
+	Queries QueryLibrary `yaml:"queries,omitempty"`
+	// Include lists further config files, directories or glob patterns,
+	// relative to this file
+	Include    []string `yaml:"include,omitempty"`
+	src        *source
+	queriesSrc map[string]*source // where each library query was defined
+	// StateFile keeps the watermarks and totals of incremental queries across
+	// restarts, relative to the config file
+	StateFile    string  `yaml:"state_file,omitempty"`
+	stateFileSrc *source // where the state file was set
 }
 
 // Job is a collection of connections and queries
 type Job struct {
 	Logger          *RotationLogger `yaml:"-"` // Logger for collecting job-level logs (connections problems, etc.)
+	connsMu         sync.Mutex      // guards conns, which change with database, target and DNS discovery
 	conns           []*connection
+	retiredConns    []*connection // retired since the last pruneState, guarded by connsMu
+	servers         []*connection // connections the databases are discovered on or the hosts resolved of
 	Name            string        `yaml:"name"`                // name of this job
 	KeepAlive       bool          `yaml:"keepalive,omitempty"` // keep connection between runs?
 	Interval        time.Duration `yaml:"interval"`            // interval at which this job is run
 	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`   // interval at which this job is run
-	Connections     []string      `yaml:"connections"`
+	Connections     Connections   `yaml:"connections"`
 	Queries         []*Query      `yaml:"queries"`
 	StartupSQL      []string      `yaml:"startup_sql,omitempty"` // SQL executed on startup
-	tracer          *opentracing.Tracer
+	// ConnectionsFrom adds the connections listed in target files, which are
+	// watched for changes
+	ConnectionsFrom *FileSD `yaml:"connections_from,omitempty"`
+	// DNSSD expands each of the Connections to one connection per DNS record
+	// of its host
+	DNSSD *DNSSD `yaml:"dns_sd,omitempty"`
+	// AutoDiscoverDatabases runs the queries on every database of the servers
+	// in Connections instead of the database in their URL
+	AutoDiscoverDatabases *DatabaseDiscovery `yaml:"auto_discover_databases,omitempty"`
+	// ReadOnly runs every query in a read-only transaction and rejects
+	// queries that write, enabled if empty
+	ReadOnly *bool `yaml:"read_only,omitempty"`
+	// CircuitBreaker stops running the queries of failing connections for a
+	// while, it is enabled with defaults if empty
+	CircuitBreaker *CircuitBreaker `yaml:"circuit_breaker,omitempty"`
+	// TLS configures TLS and client certificates of the connections
+	TLS *TLSConfig `yaml:"tls,omitempty"`
+	// Packs enable built-in query packs, e.g. postgres_core or postgres_core@1
+	Packs []string `yaml:"packs,omitempty"`
+	// DurationBuckets are the buckets of the sql_query_duration_seconds histogram
+	DurationBuckets []float64 `yaml:"duration_buckets,omitempty"`
+	// NativeHistogramBucketFactor enables native histograms for
+	// sql_query_duration_seconds if greater than 1
+	NativeHistogramBucketFactor float64 `yaml:"native_histogram_bucket_factor,omitempty"`
+	tracer                      *opentracing.Tracer
+	infoDesc                    *prometheus.Desc
+	roleDesc                    *prometheus.Desc
+	breakerDesc                 *prometheus.Desc
+	src                         *source // config file the job was read from
+	path                        string  // path of the job in src
+	// labels of targets and connections, added to all metrics
+	targetLabels []string
+	// state of the incremental queries, shared by all jobs
+	state *stateStore
+	// stop is closed by Stop to end the runs and the discovery of the job
+	stop chan struct{}
 }
 
 type connection struct {
+	mu       sync.Mutex // guards the state detected at runtime
 	conn     *sqlx.DB
 	url      *url.URL
 	driver   string
 	host     string
 	database string
 	user     string
+	version  serverVersion     // detected on connect, nil if unknown
+	cfg      *Connection       // definition in the config, nil for discovered targets
+	server   *connection       // connection the database was discovered on, if any
+	sd       string            // service discovery that added the connection, e.g. "file" or "dns"
+	labels   map[string]string // target labels of the connection
+	retired  bool              // removed from the job, guarded by mu
+	role     string            // primary or replica, detected on every run, empty if unknown
+	breaker  breaker           // circuit breaker, guarded by mu
+	// serverName is the name the host was resolved from with dns_sd, the
+	// certificate of the server is verified with it
+	serverName string
+	// tlsName is the name the TLS config is registered with for mysql
+	tlsName string
+	// discovering is set while the databases of the server are listed,
+	// guarded by mu
+	discovering bool
+	// running is set while the queries run on the connection, guarded by mu
+	running bool
 }
 
 // Query is an SQL query that is executed on a connection
@@ -68,7 +332,7 @@ type Query struct {
 	Logger     *RotationLogger `yaml:"-"` //Logger for collectiong query-level logs (invalid queries, etc.)
 	desc       *prometheus.Desc
 	errDesc    *prometheus.Desc
-	Durations  prometheus.Summary
+	durations  *prometheus.HistogramVec
 	metrics    map[*connection][]prometheus.Metric
 	Name       string   `yaml:"name"`                // the prometheus metric name
 	Help       string   `yaml:"help"`                // the prometheus metric help text
@@ -76,4 +340,61 @@ type Query struct {
 	Values     []string `yaml:"values"`              // expose each of these as an gauge
 	Query      string   `yaml:"query,flow"`          // a literal query
 	QueryRef   string   `yaml:"query_ref,omitempty"` // references an query in the query map
+	// Use references a full query definition in the query map, the fields
+	// set here take precedence
+	Use string `yaml:"use,omitempty"`
+	// Params are passed to the templates of the referenced query as {{ .Params.name }}
+	Params map[string]string `yaml:"params,omitempty"`
+	// Args are bound to the ? placeholders of the query
+	Args []QueryArg `yaml:"args,omitempty"`
+	// Incremental adds the values of the rows since the previous run to
+	// counters instead of exposing them as gauges
+	Incremental *Incremental `yaml:"incremental,omitempty"`
+	// Variants replace Query for some drivers or server versions, the first
+	// matching variant is used
+	Variants []QueryVariant `yaml:"variants,omitempty"`
+	// PreSQL is executed before the query in the same session and, in
+	// read-only mode, the same transaction, e.g. SET LOCAL statements
+	PreSQL []string `yaml:"pre_sql,omitempty"`
+	// ResultSets maps the columns of each result set to the labels and
+	// values, only the first result set is read if empty
+	ResultSets []*ResultSet `yaml:"result_sets,omitempty"`
+	// RunOn limits the query to servers of a role, primary, replica or any
+	RunOn string `yaml:"run_on,omitempty"`
+	// Type is the metric type of the values, gauge (the default), counter or
+	// untyped
+	Type string `yaml:"type,omitempty"`
+	// MinVersion and MaxVersion limit the server versions the query is run
+	// on, MinVersion is inclusive and MaxVersion exclusive
+	MinVersion string   `yaml:"min_version,omitempty"`
+	MaxVersion string   `yaml:"max_version,omitempty"`
+	drivers    []string // drivers the query is limited to, set for queries of packs
+	// MinInterval reuses the cached result of the query on job runs until it
+	// is this old, e.g. for expensive queries in a job with a short interval
+	MinInterval time.Duration `yaml:"min_interval,omitempty"`
+	// cacheAgeDesc describes the age of the cached result
+	cacheAgeDesc *prometheus.Desc
+	// targetLabels are the names of the target labels of the job's connections
+	targetLabels []string
+	// readOnly is the read_only option of the job
+	readOnly bool
+	// interval is the interval of the job
+	interval time.Duration
+	// lastRun is the start of the last successful run on each connection
+	lastRun map[*connection]time.Time
+	// job is the name of the job, state holds the watermarks and totals of
+	// incremental queries
+	job   string
+	state *stateStore
+	// AllowProcedures lists the stored procedures the query and its pre_sql
+	// may call in read-only mode, e.g. with EXEC dbo.p
+	AllowProcedures []string `yaml:"allow_procedures,omitempty"`
+}
+
+// QueryVariant is an alternative SQL text of a query
+type QueryVariant struct {
+	Driver     string `yaml:"driver,omitempty"`      // driver (connection URL scheme) of the variant, any if empty
+	MinVersion string `yaml:"min_version,omitempty"` // lowest server version of the variant
+	MaxVersion string `yaml:"max_version,omitempty"` // first server version no longer covered by the variant
+	Query      string `yaml:"query"`
 }
@@ -0,0 +1,66 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPaths(t *testing.T) {
+	dir := t.TempDir()
+	job := func(name string) string {
+		return `
+jobs:
+- name: ` + name + `
+  interval: 1m
+  connections: ['sqlite://x.db']
+  queries:
+  - {name: q, help: h, values: [v], query: 'SELECT 1 AS v'}
+`
+	}
+	files := map[string]string{
+		"jobs,a.yml":      job("a") + "include: ['teams/*.yml']\n",
+		"teams/b.yml":     job("b"),
+		"teams/c.yaml":    job("c"),
+		"teams/.hidden":   job("hidden"),
+		"teams/notes.txt": "not yaml",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		path string
+		jobs []string
+	}{
+		// a comma is part of the file name, not a separator
+		{filepath.Join(dir, "jobs,a.yml"), []string{"a", "b"}},
+		{filepath.Join(dir, "teams"), []string{"b", "c"}},
+		{filepath.Join(dir, "teams", "*.yml"), []string{"b"}},
+	} {
+		f, err := Read(tc.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		var jobs []string
+		for _, j := range f.Jobs {
+			jobs = append(jobs, j.Name)
+		}
+		if len(jobs) != len(tc.jobs) {
+			t.Fatalf("%s: got jobs %v, want %v", tc.path, jobs, tc.jobs)
+		}
+		for i := range jobs {
+			if jobs[i] != tc.jobs[i] {
+				t.Fatalf("%s: got jobs %v, want %v", tc.path, jobs, tc.jobs)
+			}
+		}
+	}
+	if _, err := Read(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Fatal("missing file read")
+	}
+}
@@ -0,0 +1,333 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+// Connection is a connection of a job. In the config it is either a URL or
+// an object with the parts of the connection, from which the DSN of the
+// driver is built. Unlike URLs the parts need no escaping, so they take
+// passwords with special characters, SQL Server instance names and Unix
+// sockets.
+type Connection struct {
+	URL    string `yaml:"url,omitempty"`    // connection URL, instead of the parts below
+	Driver string `yaml:"driver,omitempty"` // driver, e.g. postgres, pgx, mysql or sqlserver
+	// Host is the host name or address, the directory of the Unix socket
+	// (postgres, mysql) or host\instance (sqlserver)
+	Host         string            `yaml:"host,omitempty"`
+	Port         int               `yaml:"port,omitempty"`
+	Database     string            `yaml:"database,omitempty"`      // database, the file of sqlite
+	User         string            `yaml:"user,omitempty"`          // user to log in as
+	PasswordFile string            `yaml:"password_file,omitempty"` // file with the password, read on every connect
+	Params       map[string]string `yaml:"params,omitempty"`        // driver parameters
+	// Labels are added to all metrics of the connection. Connections without
+	// a label of the others get it with an empty value.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// TLS overrides the TLS config of the job
+	TLS *TLSConfig `yaml:"tls,omitempty"`
+}
+
+// Connections are the connections of a job
+type Connections []Connection
+
+// UnmarshalYAML implements yaml.Unmarshaler. Unlike the default it keeps the
+// connections with unknown fields, so that the positions of later
+// connections stay right.
+func (l *Connections) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: connections must be a list", value.Line)}}
+	}
+	conns := make(Connections, len(value.Content))
+	var errs []string
+	for i, n := range value.Content {
+		if err := conns[i].UnmarshalYAML(n); err != nil {
+			typeErr, ok := err.(*yaml.TypeError)
+			if !ok {
+				return err
+			}
+			errs = append(errs, typeErr.Errors...)
+		}
+	}
+	*l = conns
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+	return nil
+}
+
+// connectionFields is Connection without its unmarshaler
+type connectionFields Connection
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (c *Connection) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*c = Connection{URL: value.Value}
+		return nil
+	}
+	return decodeStrict(value, (*connectionFields)(c))
+}
+
+// MarshalYAML implements yaml.Marshaler, a plain URL is written as string
+func (c Connection) MarshalYAML() (interface{}, error) {
+	if c.URL != "" && c.Driver == "" && len(c.Labels) == 0 && c.TLS == nil {
+		return c.URL, nil
+	}
+	return connectionFields(c), nil
+}
+
+// driver returns the driver of the connection, empty if its URL is invalid
+func (c *Connection) driver() string {
+	if c.URL == "" {
+		return c.Driver
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme
+}
+
+// resolve makes the relative file paths relative to dir
+func (c *Connection) resolve(dir string) {
+	if c.PasswordFile != "" && !filepath.IsAbs(c.PasswordFile) {
+		c.PasswordFile = filepath.Join(dir, c.PasswordFile)
+	}
+	if c.TLS != nil {
+		c.TLS.resolve(dir)
+	}
+}
+
+// password reads the password file, so that a changed password is used on
+// the next connect
+func (c *Connection) password() (string, error) {
+	if c.PasswordFile == "" {
+		return "", nil
+	}
+	buf, err := ioutil.ReadFile(c.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(buf), "\r\n"), nil
+}
+
+// socket reports whether the host is the directory of a Unix socket
+func (c *Connection) socket() bool {
+	return strings.HasPrefix(c.Host, "/")
+}
+
+// address returns host:port, or the host if the port is not set
+func (c *Connection) address() string {
+	if c.Port == 0 {
+		if strings.Contains(c.Host, ":") {
+			// IPv6
+			return "[" + c.Host + "]"
+		}
+		return c.Host
+	}
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// url builds the URL of the connection. Without password it identifies
+// the connection without exposing the password.
+func (c *Connection) url(password string) *url.URL {
+	u := &url.URL{Scheme: c.Driver}
+	if c.User != "" {
+		u.User = url.User(c.User)
+		if password != "" {
+			u.User = url.UserPassword(c.User, password)
+		}
+	}
+	q := url.Values{}
+	for k, v := range c.Params {
+		q.Set(k, v)
+	}
+	switch {
+	case c.Driver == "sqlite":
+		u.Opaque = c.Database
+	case c.socket():
+		// lib/pq and pgx take the socket directory as parameter
+		q.Set("host", c.Host)
+		if c.Port != 0 {
+			q.Set("port", strconv.Itoa(c.Port))
+		}
+		u.Path = "/" + c.Database
+	case c.Driver == "sqlserver" || c.Driver == "mssql":
+		host, instance := c.Host, ""
+		if i := strings.Index(host, `\`); i >= 0 {
+			host, instance = host[:i], host[i+1:]
+		}
+		u.Host = (&Connection{Host: host, Port: c.Port}).address()
+		if instance != "" {
+			u.Path = "/" + instance
+		}
+		if c.Database != "" {
+			q.Set("database", c.Database)
+		}
+	default:
+		u.Host = c.address()
+		u.Path = "/" + c.Database
+	}
+	u.RawQuery = q.Encode()
+	return u
+}
+
+// mysqlDSN builds the DSN of the MySQL driver, which isn't a URL
+func (c *Connection) mysqlDSN(password string) string {
+	cfg := mysql.NewConfig()
+	cfg.User = c.User
+	cfg.Passwd = password
+	cfg.Net = "tcp"
+	cfg.Addr = c.address()
+	if c.socket() {
+		cfg.Net = "unix"
+		cfg.Addr = c.Host
+	}
+	cfg.DBName = c.Database
+	cfg.Params = c.Params
+	return cfg.FormatDSN()
+}
+
+// newConnection returns an unconnected connection for the definition
+func (c *Connection) newConnection() (*connection, error) {
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			// the parse error contains the password, so leave it out
+			return nil, fmt.Errorf("invalid connection URL")
+		}
+		conn := newConnection(u)
+		conn.cfg = c
+		conn.labels = c.Labels
+		return conn, nil
+	}
+	conn := newConnection(c.url(""))
+	conn.cfg = c
+	conn.labels = c.Labels
+	conn.host = c.address()
+	conn.database = c.Database
+	conn.user = c.User
+	return conn, nil
+}
+
+// dsn returns the DSN of the driver
+func (c *connection) dsn() (string, error) {
+	u := c.url
+	if c.cfg != nil && c.cfg.URL == "" {
+		password, err := c.cfg.password()
+		if err != nil {
+			return "", err
+		}
+		if c.driver == "mysql" {
+			return c.cfg.mysqlDSN(password), nil
+		}
+		u = c.cfg.url(password)
+	}
+	dsn := u.String()
+	switch c.driver {
+	case "mysql":
+		dsn = strings.TrimPrefix(dsn, "mysql://")
+	case "pgx":
+		// pgx takes postgres URLs, including multiple hosts like
+		// host1:5432,host2:5432 with target_session_attrs
+		dsn = "postgres://" + strings.TrimPrefix(dsn, "pgx://")
+	case "sqlite":
+		dsn = sqliteDSN(u)
+	}
+	return dsn, nil
+}
+
+// tlsConfig returns the TLS config of the connection, if any. Without
+// server_name the certificate of a resolved address is verified with the
+// name it was resolved from.
+func (c *connection) tlsConfig(job *Job) *TLSConfig {
+	t := job.TLS
+	if c.cfg != nil && c.cfg.TLS != nil {
+		t = c.cfg.TLS
+	}
+	if t != nil && t.ServerName == "" && c.serverName != "" {
+		named := *t
+		named.ServerName = c.serverName
+		return &named
+	}
+	return t
+}
+
+// withDatabase returns a connection to another database of the server c
+func (c *connection) withDatabase(name string) *connection {
+	var conn *connection
+	if c.cfg != nil && c.cfg.URL == "" {
+		cfg := *c.cfg
+		cfg.Database = name
+		conn, _ = cfg.newConnection()
+	} else {
+		u := *c.url
+		u.Path = "/" + name
+		conn = newConnection(&u)
+		conn.cfg = c.cfg
+		conn.labels = c.labels
+	}
+	conn.server = c
+	return conn
+}
+
+// withHost returns a connection to another host:port of the server c
+func (c *connection) withHost(host string) *connection {
+	var conn *connection
+	if c.cfg != nil && c.cfg.URL == "" {
+		cfg := *c.cfg
+		h, port, err := net.SplitHostPort(host)
+		if err != nil {
+			h, port = strings.Trim(host, "[]"), ""
+		}
+		cfg.Host = h
+		cfg.Port, _ = strconv.Atoi(port)
+		conn, _ = cfg.newConnection()
+	} else {
+		u := *c.url
+		u.Host = host
+		conn = newConnection(&u)
+		conn.cfg = c.cfg
+		conn.labels = c.labels
+	}
+	conn.server = c
+	return conn
+}
+
+// targetLabels returns the values of the target labels, empty if the
+// connection doesn't have one
+func (c *connection) targetLabels(names []string) []string {
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		values = append(values, c.labels[name])
+	}
+	return values
+}
+
+// connectionLabels adds the names of the labels of the connections to names
+func connectionLabels(names []string, conns Connections) []string {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	var added []string
+	for _, c := range conns {
+		for name := range c.Labels {
+			if !seen[name] {
+				seen[name] = true
+				added = append(added, name)
+			}
+		}
+	}
+	sort.Strings(added)
+	return append(names[:len(names):len(names)], added...)
+}
@@ -0,0 +1,137 @@
+package exporter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reservedMetrics are the metric names exposed by the exporter itself,
+// queries must not reuse these names
+var reservedMetrics = map[string]bool{
+	"sql_query_errors":                   true,
+	"sql_query_duration_seconds":         true,
+	"sql_query_cache_age_seconds":        true,
+	"sql_exporter_server_info":           true,
+	"sql_exporter_server_is_replica":     true,
+	"sql_exporter_circuit_breaker_state": true,
+}
+
+// metricFamily is the descriptor shared by all queries exposing the same
+// metric name
+type metricFamily struct {
+	job       string
+	query     *Query
+	pos       string
+	help      string
+	helpFrom  string   // source of the help text
+	labels    []string // sorted variable label names
+	valueType prometheus.ValueType
+}
+
+func (f *metricFamily) source() string {
+	if f.pos == "" {
+		return fmt.Sprintf("query %q in job %q", f.query.Name, f.job)
+	}
+	return fmt.Sprintf("query %q in job %q (%s)", f.query.Name, f.job, f.pos)
+}
+
+// DescriptorError lists all metric descriptor conflicts found across jobs
+type DescriptorError []string
+
+func (e DescriptorError) Error() string {
+	return "inconsistent metric descriptors:\n\t" + strings.Join(e, "\n\t")
+}
+
+// checkDescriptors verifies that all queries exposing the same metric name
+// agree on help, label names and metric type, as the prometheus registry
+// would otherwise refuse to gather them. Compatible descriptors are merged:
+// the order of label columns may differ and an empty help is taken from the
+// other queries of the same name.
+func checkDescriptors(jobs []*Job) error {
+	var errs DescriptorError
+	families := make(map[string]*metricFamily)
+	// keep the resulting error deterministic, first come first served
+	for _, j := range jobs {
+		if j == nil {
+			continue
+		}
+		for i, q := range j.Queries {
+			if q == nil {
+				continue
+			}
+			name := q.metricName()
+			cur := &metricFamily{
+				job:       j.Name,
+				query:     q,
+				pos:       j.at(fmt.Sprintf("queries[%d]", i)),
+				help:      q.Help,
+				labels:    q.labelNames(),
+				valueType: q.valueType(),
+			}
+			cur.helpFrom = cur.source()
+			sort.Strings(cur.labels)
+			for i := 1; i < len(cur.labels); i++ {
+				if cur.labels[i] == cur.labels[i-1] {
+					errs = append(errs, fmt.Sprintf("metric %q: %s uses label %q more than once (labels %s are always added)",
+						name, cur.source(), cur.labels[i], strings.Join(staticLabels, ", ")))
+				}
+			}
+			if reservedMetrics[name] {
+				errs = append(errs, fmt.Sprintf("metric %q: %s collides with a metric of the exporter itself", name, cur.source()))
+				continue
+			}
+			prev, ok := families[name]
+			if !ok {
+				families[name] = cur
+				continue
+			}
+			if prev.valueType != cur.valueType {
+				errs = append(errs, fmt.Sprintf("metric %q: %s is a %s, but %s is a %s",
+					name, cur.source(), typeName(cur.valueType), prev.source(), typeName(prev.valueType)))
+			}
+			if strings.Join(prev.labels, ",") != strings.Join(cur.labels, ",") {
+				errs = append(errs, fmt.Sprintf("metric %q: %s has labels [%s], but %s has labels [%s]",
+					name, cur.source(), strings.Join(cur.labels, " "), prev.source(), strings.Join(prev.labels, " ")))
+			}
+			switch {
+			case cur.help == "" || prev.help == cur.help:
+			case prev.help == "":
+				prev.help, prev.helpFrom = cur.help, cur.helpFrom
+			default:
+				errs = append(errs, fmt.Sprintf("metric %q: %s has help %q, but %s has help %q",
+					name, cur.source(), cur.help, prev.helpFrom, prev.help))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	// merge compatible descriptors
+	for _, j := range jobs {
+		if j == nil {
+			continue
+		}
+		for _, q := range j.Queries {
+			if q == nil || q.Help != "" {
+				continue
+			}
+			if f, ok := families[q.metricName()]; ok {
+				q.Help = f.help
+			}
+		}
+	}
+	return nil
+}
+
+func typeName(t prometheus.ValueType) string {
+	switch t {
+	case prometheus.CounterValue:
+		return "counter"
+	case prometheus.GaugeValue:
+		return "gauge"
+	}
+	return "untyped metric"
+}
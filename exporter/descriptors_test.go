@@ -0,0 +1,95 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCheckDescriptors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		queries string
+		err     string // part of the error, none if empty
+	}{
+		{
+			name: "compatible",
+			queries: `
+  - {name: q, help: h, labels: [a, b], values: [v], query: 'SELECT 1'}
+  - {name: q, labels: [b, a], values: [w], query: 'SELECT 1'}`,
+		},
+		{
+			name: "types",
+			queries: `
+  - {name: q, help: h, values: [v], query: 'SELECT 1'}
+  - {name: q, help: h, values: [v], query: 'SELECT 1', type: counter}`,
+			err: `c.yml:12) is a counter, but query "q" in job "a"`,
+		},
+		{
+			name: "labels",
+			queries: `
+  - {name: q, help: h, labels: [a], values: [v], query: 'SELECT 1'}
+  - {name: q, help: h, values: [v], query: 'SELECT 1'}`,
+			err: `has labels [col database driver host user], but query "q" in job "a"`,
+		},
+		{
+			name: "help",
+			queries: `
+  - {name: q, help: h, values: [v], query: 'SELECT 1'}
+  - {name: q, help: other, values: [v], query: 'SELECT 1'}`,
+			err: `has help "other", but query "q" in job "a"`,
+		},
+		{
+			name: "reserved",
+			queries: `
+  - {name: query_errors, help: h, values: [v], query: 'SELECT 1'}
+  - {name: x, help: h, values: [v], query: 'SELECT 1'}`,
+			err: `collides with a metric of the exporter itself`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			queries := strings.SplitN(strings.TrimPrefix(tc.queries, "\n"), "\n", 2)
+			config := `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+` + queries[0] + `
+- name: b
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+` + queries[1] + `
+`
+			path := writeTestConfig(t, dir, config)
+			_, err := NewExporter(nil, newRotationLogger(log.NewNopLogger(), 10), path)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatal(err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("got error %v, want %s", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestValueType(t *testing.T) {
+	for _, tc := range []struct {
+		query *Query
+		want  prometheus.ValueType
+	}{
+		{&Query{}, prometheus.GaugeValue},
+		{&Query{Type: "gauge"}, prometheus.GaugeValue},
+		{&Query{Type: "counter"}, prometheus.CounterValue},
+		{&Query{Type: "untyped"}, prometheus.UntypedValue},
+		{&Query{Incremental: &Incremental{Watermark: "id"}}, prometheus.CounterValue},
+	} {
+		if got := tc.query.valueType(); got != tc.want {
+			t.Errorf("type %q: got %v, want %v", tc.query.Type, got, tc.want)
+		}
+	}
+}
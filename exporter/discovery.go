@@ -0,0 +1,183 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// discoveryQueries list the databases of a server for each driver, without
+// the templates and system schemas
+var discoveryQueries = map[string]string{
+	"postgres": "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate",
+	"mysql":    "SELECT schema_name FROM information_schema.schemata WHERE schema_name NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys')",
+}
+
+// discoveryTimeout limits the wait for the databases of the servers
+var discoveryTimeout = 10 * time.Second
+
+// DatabaseDiscovery runs the queries of a job on every database of its
+// servers instead of the database in the connection URL
+type DatabaseDiscovery struct {
+	Include string `yaml:"include,omitempty"` // regexp of the database names to include, all if empty
+	Exclude string `yaml:"exclude,omitempty"` // regexp of the database names to exclude
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	// RefreshInterval is the interval the databases are listed at
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+func (d *DatabaseDiscovery) interval() time.Duration {
+	if d.RefreshInterval > 0 {
+		return d.RefreshInterval
+	}
+	return defaultRefreshInterval
+}
+
+// compile compiles the regular expressions. Like relabeling rules of
+// Prometheus they are anchored, so "app" doesn't match "app_test".
+func (d *DatabaseDiscovery) compile() error {
+	var err error
+	if d.include, err = compileAnchored(d.Include); err != nil {
+		return fmt.Errorf("include: %v", err)
+	}
+	if d.exclude, err = compileAnchored(d.Exclude); err != nil {
+		return fmt.Errorf("exclude: %v", err)
+	}
+	return nil
+}
+
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// match reports whether the database name is to be monitored
+func (d *DatabaseDiscovery) match(name string) bool {
+	if d.include != nil && !d.include.MatchString(name) {
+		return false
+	}
+	return d.exclude == nil || !d.exclude.MatchString(name)
+}
+
+// discoverDatabases adds a connection for every new database of the servers
+// of the job and retires the connections of vanished databases. The
+// databases of an unreachable server are kept until it is reachable again.
+//
+// The servers are listed concurrently and waited for up to discoveryTimeout.
+// A server that takes longer is synced once it answers, it isn't listed again
+// until then.
+func (j *Job) discoverDatabases() {
+	if j.AutoDiscoverDatabases == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, server := range j.servers {
+		if !server.startDiscovery() {
+			level.Warn(j.Logger).Log("msg", "Skipping database discovery. The previous one didn't finish", "host", server.host)
+			continue
+		}
+		wg.Add(1)
+		go func(server *connection) {
+			defer wg.Done()
+			defer server.endDiscovery()
+			names, err := server.databases(j)
+			if err != nil {
+				level.Warn(j.Logger).Log("msg", "Failed to discover databases", "err", err, "host", server.host)
+				return
+			}
+			found := make(map[string]bool, len(names))
+			for _, name := range names {
+				if j.AutoDiscoverDatabases.match(name) {
+					found[name] = true
+				}
+			}
+			j.syncDatabases(server, found)
+		}(server)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(discoveryTimeout):
+		level.Warn(j.Logger).Log("msg", "Database discovery timed out", "timeout", discoveryTimeout)
+	}
+}
+
+// startDiscovery marks the server as being listed, it returns false if the
+// previous discovery is still running
+func (c *connection) startDiscovery() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.discovering {
+		return false
+	}
+	c.discovering = true
+	return true
+}
+
+func (c *connection) endDiscovery() {
+	c.mu.Lock()
+	c.discovering = false
+	c.mu.Unlock()
+}
+
+// databases lists the databases of the server
+func (c *connection) databases(job *Job) ([]string, error) {
+	query, ok := discoveryQueries[dialect(c.driver)]
+	if !ok {
+		return nil, fmt.Errorf("database discovery is not supported for driver %q", c.driver)
+	}
+	if err := c.connect(job); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	var names []string
+	if err := c.conn.SelectContext(ctx, &names, query); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// watchDatabases lists the databases of the servers at the refresh interval
+// until the job is stopped
+func (j *Job) watchDatabases() {
+	ticker := time.NewTicker(j.AutoDiscoverDatabases.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.discoverDatabases()
+		}
+	}
+}
+
+// syncDatabases updates the connections discovered on server to the
+// databases found
+func (j *Job) syncDatabases(server *connection, found map[string]bool) {
+	want := make(map[string]*connection, len(found))
+	for name := range found {
+		c := server.withDatabase(name)
+		c.sd = "databases"
+		want[c.key()] = c
+	}
+	added, retired := j.syncConnections(func(c *connection) bool { return c.server == server }, want)
+	for _, c := range added {
+		level.Info(j.Logger).Log("msg", "Discovered database", "host", c.host, "db", c.database)
+	}
+	for _, c := range retired {
+		level.Info(j.Logger).Log("msg", "Database vanished", "host", c.host, "db", c.database)
+	}
+}
@@ -0,0 +1,74 @@
+package exporter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryTimeout(t *testing.T) {
+	// a server that accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hung := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			hung <- c
+		}
+	}()
+
+	defer func(timeout time.Duration) { discoveryTimeout = timeout }(discoveryTimeout)
+	discoveryTimeout = 100 * time.Millisecond
+	exp := newTestExporter(t, t.TempDir(), `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@`+l.Addr().String()+`/db?sslmode=disable&connect_timeout=10']
+  auto_discover_databases: {}
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+`)
+	j := exp.jobs[0]
+	start := time.Now()
+	j.discoverDatabases()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("discovery waited %v for the hung server", d)
+	}
+	var conn net.Conn
+	select {
+	case conn = <-hung:
+		defer conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the server wasn't listed")
+	}
+
+	// the server is not listed again while the previous discovery hangs
+	j.discoverDatabases()
+	select {
+	case c := <-hung:
+		c.Close()
+		t.Fatal("the hung server was listed again")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestValidateDiscovery(t *testing.T) {
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@host/db']
+  auto_discover_databases: {include: 'app_.*', refresh_interval: -1m}
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+`,
+		`c.yml:6: job "a": refresh_interval must not be negative`,
+	)
+}
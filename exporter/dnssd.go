@@ -0,0 +1,125 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// dnsTimeout limits a single DNS lookup
+const dnsTimeout = 10 * time.Second
+
+// DNSSD expands every connection of a job to one connection per DNS record
+// of its host, so that each replica behind a service name is monitored with
+// its own host label
+type DNSSD struct {
+	// Type is A to use the A and AAAA records of the host with the port of
+	// the URL, or SRV to use the targets and ports of the SRV records of the
+	// host, e.g. _postgres._tcp.db.service.consul
+	Type            string        `yaml:"type,omitempty"`
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"` // interval the hosts are resolved at
+}
+
+func (d *DNSSD) recordType() string {
+	if d.Type == "" {
+		return "A"
+	}
+	return strings.ToUpper(d.Type)
+}
+
+func (d *DNSSD) interval() time.Duration {
+	if d.RefreshInterval > 0 {
+		return d.RefreshInterval
+	}
+	return defaultRefreshInterval
+}
+
+// lookup returns the addresses (host:port) the host of u resolves to
+func (d *DNSSD) lookup(u *url.URL) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	var hosts []string
+	switch d.recordType() {
+	case "SRV":
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+	case "A":
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if u.Port() == "" {
+				host := ip.String()
+				if ip.IP.To4() == nil {
+					host = "[" + host + "]"
+				}
+				hosts = append(hosts, host)
+				continue
+			}
+			hosts = append(hosts, net.JoinHostPort(ip.String(), u.Port()))
+		}
+	default:
+		return nil, fmt.Errorf("unknown DNS record type %q", d.Type)
+	}
+	return hosts, nil
+}
+
+// resolveHosts adds a connection for every new DNS record of the hosts of
+// the job and retires the connections of vanished records. If a host can't
+// be resolved, its previous records are kept.
+func (j *Job) resolveHosts() {
+	if j.DNSSD == nil {
+		return
+	}
+	for _, server := range j.servers {
+		hosts, err := j.DNSSD.lookup(server.url)
+		if err != nil {
+			level.Warn(j.Logger).Log("msg", "Failed to resolve host, keeping the previous records", "err", err, "host", server.host)
+			continue
+		}
+		want := make(map[string]*connection, len(hosts))
+		for _, host := range hosts {
+			c := server.withHost(host)
+			c.sd = "dns"
+			if j.DNSSD.recordType() == "A" {
+				// the host is an address, unlike the targets of SRV records
+				c.serverName = server.url.Hostname()
+			}
+			want[c.key()] = c
+		}
+		added, retired := j.syncConnections(func(c *connection) bool { return c.server == server }, want)
+		for _, c := range added {
+			level.Info(j.Logger).Log("msg", "Resolved host", "host", c.host, "name", server.host, "db", c.database)
+		}
+		for _, c := range retired {
+			level.Info(j.Logger).Log("msg", "Host vanished", "host", c.host, "name", server.host, "db", c.database)
+		}
+	}
+}
+
+// watchHosts resolves the hosts of the job at the refresh interval until the
+// job is stopped
+func (j *Job) watchHosts() {
+	ticker := time.NewTicker(j.DNSSD.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.resolveHosts()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package exporter
+
+import (
+	"testing"
+)
+
+func TestResolveHostsServerName(t *testing.T) {
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['pgx://user@localhost:5432/db']
+  dns_sd: {}
+  tls: {}
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+`)
+	j := exp.jobs[0]
+	conns := j.connections()
+	if len(conns) == 0 {
+		t.Fatal("localhost didn't resolve")
+	}
+	for _, c := range conns {
+		if c.host == "localhost:5432" {
+			t.Fatalf("host %q isn't an address", c.host)
+		}
+		// the certificate names the host, not its address
+		if name := c.tlsConfig(j).ServerName; name != "localhost" {
+			t.Errorf("%s: got server name %q, want localhost", c.host, name)
+		}
+	}
+	if j.TLS.ServerName != "" {
+		t.Errorf("the TLS config of the job was changed to %q", j.TLS.ServerName)
+	}
+
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@localhost:5432/db']
+  dns_sd: {}
+  tls: {}
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+`,
+		`c.yml:5: job "a": tls: lib/pq verifies the resolved addresses instead of the host name, use pgx:// instead`,
+	)
+}
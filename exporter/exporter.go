@@ -2,6 +2,7 @@ package exporter
 
 import (
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,18 +25,36 @@ func NewExporter(tracer opentracing.Tracer, logger *RotationLogger, configFile s
 	if err != nil {
 		return nil, err
 	}
+	// metrics of the same name must share their descriptor, reject the config
+	// before any descriptor is built
+	if err := checkDescriptors(cfg.Jobs); err != nil {
+		return nil, err
+	}
 
 	exp := &Exporter{
 		jobs:   make([]*Job, 0, len(cfg.Jobs)),
 		logger: logger,
 	}
 
+	// the counters of incremental queries start over if the state is lost,
+	// which prometheus handles like any other counter reset
+	state, err := loadState(cfg.StateFile)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Failed to read the state file, incremental queries start over", "err", err)
+	}
+	if cfg.StateFile == "" && cfg.hasIncremental() {
+		level.Warn(logger).Log("msg", "No state_file configured, incremental queries start over on every restart")
+	}
+	// queries that were removed or renamed leave their state behind
+	state.pruneQueries(cfg.Jobs)
+
 	// dispatch all jobs
 	for _, job := range cfg.Jobs {
 		if job == nil {
 			continue
 		}
-		if err := job.Init(tracer, logger, cfg.Queries); err != nil {
+		job.state = state
+		if err := job.Init(tracer, logger); err != nil {
 			level.Warn(logger).Log("msg", "Skipping job. Failed to initialize", "err", err, "job", job.Name)
 			continue
 		}
@@ -82,6 +101,11 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 		if job == nil {
 			continue
 		}
+		if job.infoDesc != nil {
+			ch <- job.infoDesc
+			ch <- job.roleDesc
+			ch <- job.breakerDesc
+		}
 		for _, query := range job.Queries {
 			if query == nil {
 				continue
@@ -92,6 +116,14 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 			}
 			ch <- query.desc
 			ch <- query.errDesc
+			if query.cacheAgeDesc != nil {
+				ch <- query.cacheAgeDesc
+			}
+			// per-query collectors are owned by the exporter and must never be
+			// registered globally, so that jobs can be created and discarded freely
+			if query.durations != nil {
+				query.durations.Describe(ch)
+			}
 		}
 	}
 }
@@ -102,19 +134,74 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 		if job == nil {
 			continue
 		}
+		if job.infoDesc != nil {
+			for _, conn := range job.connections() {
+				state, _ := conn.breakerState()
+				ch <- prometheus.MustNewConstMetric(
+					job.breakerDesc,
+					prometheus.GaugeValue,
+					float64(state),
+					append([]string{conn.driver, conn.host, conn.database, conn.user}, conn.targetLabels(job.targetLabels)...)...,
+				)
+				version, role := conn.serverVersion(), conn.serverRole()
+				if version == nil && role == "" {
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(
+					job.infoDesc,
+					prometheus.GaugeValue,
+					1,
+					append([]string{conn.driver, conn.host, conn.database, conn.user, version.String(), role}, conn.targetLabels(job.targetLabels)...)...,
+				)
+				if role == "" {
+					continue
+				}
+				replica := 0.0
+				if role == roleReplica {
+					replica = 1
+				}
+				ch <- prometheus.MustNewConstMetric(
+					job.roleDesc,
+					prometheus.GaugeValue,
+					replica,
+					append([]string{conn.driver, conn.host, conn.database, conn.user}, conn.targetLabels(job.targetLabels)...)...,
+				)
+			}
+		}
 		for _, query := range job.Queries {
 			if query == nil {
 				continue
 			}
+			query.Lock()
 			for _, metrics := range query.metrics {
 				for _, metric := range metrics {
 					ch <- metric
 				}
 			}
+			for conn, last := range query.lastRun {
+				if query.cacheAgeDesc == nil {
+					// the query doesn't use min_interval
+					break
+				}
+				ch <- prometheus.MustNewConstMetric(
+					query.cacheAgeDesc,
+					prometheus.GaugeValue,
+					time.Since(last).Seconds(),
+					append([]string{conn.driver, conn.host, conn.database, conn.user}, conn.targetLabels(job.targetLabels)...)...,
+				)
+			}
+			query.Unlock()
+			if query.durations != nil {
+				query.durations.Collect(ch)
+			}
+			if query.errDesc == nil {
+				// skipped by Init
+				continue
+			}
 			ch <- prometheus.MustNewConstMetric(
 				query.errDesc,
 				prometheus.CounterValue,
-				float64(query.Logger.errorCounter),
+				float64(query.Logger.errors()),
 			)
 		}
 	}
@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestExporter writes config to a temporary directory and returns the
+// exporter of it. The config may refer to the directory as DIR.
+func newTestExporter(t *testing.T, dir string, config string) *Exporter {
+	t.Helper()
+	path := writeTestConfig(t, dir, config)
+	exp, err := NewExporter(nil, newRotationLogger(log.NewNopLogger(), 10), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exp
+}
+
+// writeTestConfig writes config to c.yml in dir, replacing DIR by dir
+func writeTestConfig(t *testing.T, dir string, config string) string {
+	t.Helper()
+	path := filepath.Join(dir, "c.yml")
+	config = strings.ReplaceAll(config, "DIR", dir)
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCollectUninitializedJob(t *testing.T) {
+	// e.g. a job whose Init failed, none of its descriptors and collectors
+	// are set
+	exp := &Exporter{
+		jobs:   []*Job{{Name: "a", Queries: []*Query{{Name: "q"}, nil}}},
+		logger: newRotationLogger(log.NewNopLogger(), 10),
+	}
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(exp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewExporterDoesNotConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan bool, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+			accepted <- true
+		}
+	}()
+
+	// database discovery only connects when the job runs
+	newTestExporter(t, t.TempDir(), `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@`+l.Addr().String()+`/db?sslmode=disable']
+  auto_discover_databases: {}
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+`)
+	select {
+	case <-accepted:
+		t.Fatal("NewExporter connected to the server")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
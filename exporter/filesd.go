@@ -0,0 +1,197 @@
+package exporter
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRefreshInterval is the interval target files are read at by default
+const defaultRefreshInterval = time.Minute
+
+// FileSD reads the connections of a job from JSON or YAML files in the format
+// of the file_sd_configs of Prometheus, e.g.
+//
+//	[{"targets": ["postgres://host/db"], "labels": {"env": "prod"}}]
+type FileSD struct {
+	Files           []string      `yaml:"files"`                      // files or glob patterns, relative to the config file
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"` // interval the files are read at
+	// Labels are the target labels added to every metric of the job. As the
+	// label names of a metric can't change at runtime, other labels of the
+	// targets are ignored.
+	Labels []string `yaml:"labels,omitempty"`
+}
+
+// targetGroup is an entry of a target file
+type targetGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// target is a connection URL read from a target file
+type target struct {
+	url    *url.URL
+	labels map[string]string
+}
+
+func (sd *FileSD) interval() time.Duration {
+	if sd.RefreshInterval > 0 {
+		return sd.RefreshInterval
+	}
+	return defaultRefreshInterval
+}
+
+// resolve makes the relative file patterns relative to dir
+func (sd *FileSD) resolve(dir string) {
+	for i, pattern := range sd.Files {
+		if pattern != "" && !filepath.IsAbs(pattern) {
+			sd.Files[i] = filepath.Join(dir, pattern)
+		}
+	}
+}
+
+// readTargets reads all target files. Targets are checked like the
+// connections of the config, the TLS options of the job included.
+func (sd *FileSD) readTargets(tls *TLSConfig) ([]target, error) {
+	var targets []target
+	for _, pattern := range sd.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		for _, file := range files {
+			buf, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			// JSON is valid YAML
+			var groups []targetGroup
+			if err := yaml.Unmarshal(buf, &groups); err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			for i, group := range groups {
+				labels := make(map[string]string, len(sd.Labels))
+				for _, name := range sd.Labels {
+					if value, ok := group.Labels[name]; ok {
+						labels[name] = value
+					}
+				}
+				for k, t := range group.Targets {
+					u, err := url.Parse(t)
+					if err != nil {
+						// the parse error contains the password, so leave it out
+						return nil, fmt.Errorf("%s: target %d of group %d is not a valid URL", file, k, i)
+					}
+					if problem := checkTarget(u, tls); problem != "" {
+						return nil, fmt.Errorf("%s: target %d of group %d: %s", file, k, i, problem)
+					}
+					targets = append(targets, target{url: u, labels: labels})
+				}
+			}
+		}
+	}
+	return targets, nil
+}
+
+// refreshTargets reads the target files and updates the connections of the
+// job. If the files can't be read, the previous targets are kept.
+func (j *Job) refreshTargets() {
+	if j.ConnectionsFrom == nil {
+		return
+	}
+	targets, err := j.ConnectionsFrom.readTargets(j.TLS)
+	if err != nil {
+		level.Warn(j.Logger).Log("msg", "Failed to read targets, keeping the previous ones", "err", err)
+		return
+	}
+	for _, t := range targets {
+		if problem := j.roleProblem(t.url.Scheme); problem != "" {
+			level.Warn(j.Logger).Log("msg", "Failed to read targets, keeping the previous ones", "err", problem)
+			return
+		}
+	}
+	j.syncTargets(targets)
+}
+
+// checkTarget reports the problem of a target URL, empty if there is none
+func checkTarget(u *url.URL, t *TLSConfig) string {
+	known := false
+	for _, d := range sql.Drivers() {
+		known = known || d == u.Scheme
+	}
+	switch {
+	case !known:
+		return fmt.Sprintf("unknown driver %q", u.Scheme)
+	case u.Scheme == "sqlite" && sqlitePath(u) == "":
+		return "no database"
+	case u.Scheme != "sqlite" && u.Host == "":
+		return "no host"
+	case t != nil:
+		return t.checkDriver(u.Scheme)
+	}
+	return ""
+}
+
+// syncTargets adds a connection for every new target and retires the
+// connections of removed targets
+func (j *Job) syncTargets(targets []target) {
+	want := make(map[string]*connection, len(targets))
+	for _, t := range targets {
+		c := newConnection(t.url)
+		c.sd = "file"
+		c.labels = t.labels
+		want[c.key()] = c
+	}
+	added, retired := j.syncConnections(func(c *connection) bool { return c.sd == "file" }, want)
+	for _, c := range added {
+		level.Info(j.Logger).Log("msg", "Target added", "driver", c.driver, "host", c.host, "db", c.database)
+	}
+	for _, c := range retired {
+		level.Info(j.Logger).Log("msg", "Target removed", "driver", c.driver, "host", c.host, "db", c.database)
+	}
+}
+
+// watchTargets reads the target files at the refresh interval until the job
+// is stopped
+func (j *Job) watchTargets() {
+	ticker := time.NewTicker(j.ConnectionsFrom.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.refreshTargets()
+		}
+	}
+}
+
+// resolveTargetLabels adds the target labels of each job, from target files
+// and connections, to its queries
+func (f *File) resolveTargetLabels() {
+	for _, j := range f.Jobs {
+		if j != nil {
+			j.shareTargetLabels()
+		}
+	}
+}
+
+func (j *Job) shareTargetLabels() {
+	var names []string
+	if j.ConnectionsFrom != nil {
+		names = j.ConnectionsFrom.Labels
+	}
+	names = connectionLabels(names, j.Connections)
+	j.targetLabels = names
+	for _, q := range j.Queries {
+		if q != nil {
+			q.targetLabels = names
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefreshTargets(t *testing.T) {
+	dir := t.TempDir()
+	targets := filepath.Join(dir, "targets.yml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(targets, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[{targets: ['sqlite://DIR/x.db']}]`)
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections_from: {files: [targets.yml], refresh_interval: 10ms}
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+`)
+	j := exp.jobs[0]
+	if conns := j.connections(); len(conns) != 1 || conns[0].driver != "sqlite" {
+		t.Fatalf("got connections %v, want the sqlite target", conns)
+	}
+
+	// invalid targets are rejected like invalid connections of the config,
+	// the previous targets are kept
+	for _, content := range []string{
+		`[{targets: ['oracle://host/db']}]`,
+		`[{targets: ['postgres:///db']}]`,
+	} {
+		write(content)
+		j.refreshTargets()
+		if conns := j.connections(); len(conns) != 1 || conns[0].driver != "sqlite" {
+			t.Fatalf("%s: got connections %v, want the previous target", content, conns)
+		}
+	}
+
+	// the targets are watched until the job is stopped
+	done := make(chan bool)
+	go func() {
+		j.watchTargets()
+		done <- true
+	}()
+	j.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchTargets didn't return after Stop")
+	}
+}
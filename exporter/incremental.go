@@ -0,0 +1,506 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// argWatermark is the runtime argument bound to the watermark of an
+// incremental query
+const argWatermark = "watermark"
+
+// Incremental builds counters from the rows added since the previous run,
+// e.g. of append-only event tables. The query selects the rows after the
+// watermark, bound as the runtime argument watermark, and returns the new
+// watermark in a column. The values are added to running totals, which are
+// exposed as counters and kept in the state file along with the watermark.
+//
+// A watermark lower than the previous one means the table was truncated or
+// recreated: the run is discarded and the next one starts over from the
+// initial watermark. To notice that, the watermark column has to return
+// the highest id or timestamp of the whole table, not only of the new rows.
+type Incremental struct {
+	Watermark string      `yaml:"watermark"`         // column holding the highest id or timestamp seen
+	Initial   interface{} `yaml:"initial,omitempty"` // watermark of the first run, 0 if empty
+}
+
+func (inc *Incremental) initial() *watermark {
+	if inc.Initial == nil {
+		return &watermark{Kind: "int", Value: "0"}
+	}
+	return newWatermark(inc.Initial)
+}
+
+// watermark is the position an incremental query reached, kept as text so
+// that ids and timestamps survive the state file alike
+type watermark struct {
+	Kind  string `json:"kind"` // int, float, time or string
+	Value string `json:"value"`
+}
+
+// newWatermark converts a column value, it returns nil for NULL
+func newWatermark(i interface{}) *watermark {
+	switch v := i.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		return &watermark{Kind: "time", Value: v.UTC().Format(time.RFC3339Nano)}
+	case []byte:
+		return newWatermark(string(v))
+	case string:
+		// e.g. numeric columns of pgx arrive in their text form
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return &watermark{Kind: "int", Value: v}
+		}
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return &watermark{Kind: "float", Value: v}
+		}
+		return &watermark{Kind: "string", Value: v}
+	}
+	v := reflect.ValueOf(i)
+	switch v.Kind() {
+	case reflect.Ptr:
+		// nullable ClickHouse columns
+		if v.IsNil() {
+			return nil
+		}
+		return newWatermark(v.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &watermark{Kind: "int", Value: strconv.FormatInt(v.Int(), 10)}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &watermark{Kind: "int", Value: strconv.FormatUint(v.Uint(), 10)}
+	case reflect.Float32, reflect.Float64:
+		return &watermark{Kind: "float", Value: strconv.FormatFloat(v.Float(), 'g', -1, 64)}
+	}
+	return &watermark{Kind: "string", Value: fmt.Sprint(i)}
+}
+
+// arg returns the value bound to the query
+func (w *watermark) arg() interface{} {
+	switch w.Kind {
+	case "int":
+		if n, err := strconv.ParseInt(w.Value, 10, 64); err == nil {
+			return n
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(w.Value, 64); err == nil {
+			return f
+		}
+	case "time":
+		if t, err := time.Parse(time.RFC3339Nano, w.Value); err == nil {
+			return t
+		}
+	}
+	return w.Value
+}
+
+// less reports whether w is lower than o. Watermarks of different kinds,
+// other than ints and floats, are never lower.
+func (w *watermark) less(o *watermark) bool {
+	switch {
+	case w.Kind == "string" && o.Kind == "string":
+		return w.Value < o.Value
+	case w.Kind == "time" && o.Kind == "time":
+		a, aerr := time.Parse(time.RFC3339Nano, w.Value)
+		b, berr := time.Parse(time.RFC3339Nano, o.Value)
+		return aerr == nil && berr == nil && a.Before(b)
+	case w.Kind == "int" && o.Kind == "int":
+		a, aerr := strconv.ParseInt(w.Value, 10, 64)
+		b, berr := strconv.ParseInt(o.Value, 10, 64)
+		if aerr == nil && berr == nil {
+			return a < b
+		}
+		fallthrough
+	case w.numeric() && o.numeric():
+		a, aerr := strconv.ParseFloat(w.Value, 64)
+		b, berr := strconv.ParseFloat(o.Value, 64)
+		return aerr == nil && berr == nil && a < b
+	}
+	return false
+}
+
+func (w *watermark) numeric() bool {
+	return w.Kind == "int" || w.Kind == "float"
+}
+
+// stateVersion is the format of the state file
+const stateVersion = 1
+
+// stateStore keeps the watermarks and totals of incremental queries. They
+// are saved to the state file after every run of a job that changed them, if
+// there is one.
+type stateStore struct {
+	mu      sync.Mutex
+	path    string
+	queries map[string]*incrementalState // by job, query and connection
+	dirty   bool                         // changed since the last save
+}
+
+// stateFile is the content of the state file
+type stateFile struct {
+	Version int                          `json:"version"`
+	Queries map[string]*incrementalState `json:"queries"`
+}
+
+// incrementalState is the state of an incremental query on a connection
+type incrementalState struct {
+	Watermark *watermark     `json:"watermark,omitempty"`
+	Totals    []*seriesTotal `json:"totals,omitempty"`
+}
+
+// seriesTotal is the running total of a series
+type seriesTotal struct {
+	Labels []string `json:"labels"` // values of the label columns, then the value column
+	Value  float64  `json:"value"`
+}
+
+// loadState reads the state file at path. A missing file is an empty state,
+// an empty path keeps the state in memory only.
+func loadState(path string) (*stateStore, error) {
+	s := &stateStore{
+		path:    path,
+		queries: make(map[string]*incrementalState),
+	}
+	if path == "" {
+		return s, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var f stateFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return s, fmt.Errorf("%s: %v", path, err)
+	}
+	if f.Version != stateVersion {
+		return s, fmt.Errorf("%s: unsupported version %d", path, f.Version)
+	}
+	for key, st := range f.Queries {
+		if st != nil {
+			s.queries[key] = st
+		}
+	}
+	return s, nil
+}
+
+// update changes the state of key, which is saved by the next flush
+func (s *stateStore) update(key string, fn func(st *incrementalState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.queries[key]
+	if !ok {
+		st = &incrementalState{}
+		s.queries[key] = st
+	}
+	fn(st)
+	s.dirty = true
+}
+
+// prune drops the states of the keys keep rejects
+func (s *stateStore) prune(keep func(key string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.queries {
+		if !keep(key) {
+			delete(s.queries, key)
+			s.dirty = true
+		}
+	}
+}
+
+// flush saves the state file if the state changed. The state is kept in
+// memory even if it cannot be saved, the next flush tries again.
+func (s *stateStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// watermark returns the watermark of key, nil if there is none yet
+func (s *stateStore) watermark(key string) *watermark {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.queries[key]; ok {
+		return st.Watermark
+	}
+	return nil
+}
+
+// save writes the state file, guarded by mu. The file is replaced at once,
+// after it reached the disk, so that a crash never leaves half of it behind.
+func (s *stateStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(stateFile{Version: stateVersion, Queries: s.queries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	// the rename itself is only durable once the directory is synced
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// statePrefix starts the keys of the states of a query
+func statePrefix(job, query string) string {
+	return job + "/" + query + "/"
+}
+
+// stateKey identifies the query and connection in the state file. The
+// connection is identified by its parts, so that no password is written.
+func (q *Query) stateKey(conn *connection) string {
+	key := fmt.Sprintf("%s%s://%s@%s/%s", statePrefix(q.job, q.Name), conn.driver, conn.user, conn.host, conn.database)
+	if len(conn.labels) == 0 {
+		return key
+	}
+	names := make([]string, 0, len(conn.labels))
+	for name := range conn.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, conn.labels[name]))
+	}
+	return key + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// watermark returns the watermark the next run on conn starts after
+func (q *Query) watermark(conn *connection) interface{} {
+	if w := q.state.watermark(q.stateKey(conn)); w != nil {
+		return w.arg()
+	}
+	return q.Incremental.initial().arg()
+}
+
+// accumulate adds the values of the rows of a run to the totals of the
+// connection and returns the counters of all series seen so far
+func (q *Query) accumulate(conn *connection, rows []map[string]interface{}) ([]prometheus.Metric, error) {
+	inc := q.Incremental
+	var next *watermark
+	for _, res := range rows {
+		w := newWatermark(res[inc.Watermark])
+		if w == nil {
+			// the rows would be added again by every run
+			return nil, fmt.Errorf("Column '%s' of the watermark is missing or NULL, no rows were added", inc.Watermark)
+		}
+		if next == nil || next.less(w) {
+			next = w
+		}
+	}
+	var metrics []prometheus.Metric
+	var err error
+	q.state.update(q.stateKey(conn), func(st *incrementalState) {
+		prev := st.Watermark
+		if prev == nil {
+			prev = inc.initial()
+		}
+		if next != nil && next.less(prev) {
+			level.Warn(q.Logger).Log("msg", "Watermark went back, starting over from the initial watermark",
+				"watermark", next.Value, "previous", prev.Value, "host", conn.host, "db", conn.database)
+			st.Watermark = inc.initial()
+		} else {
+			totals := make(map[string]*seriesTotal, len(st.Totals))
+			for _, t := range st.Totals {
+				totals[strings.Join(t.Labels, "\xff")] = t
+			}
+			// check all rows first, a run is added completely or not at all
+			type addition struct {
+				labels []string
+				value  float64
+			}
+			var adds []addition
+			for _, res := range rows {
+				labels, lerr := q.rowLabels(res)
+				if lerr != nil {
+					err = lerr
+					return
+				}
+				for _, valueName := range q.Values {
+					value, verr := q.value(res, valueName)
+					if verr != nil {
+						err = verr
+						return
+					}
+					if value < 0 {
+						err = fmt.Errorf("Column '%s' must not be negative in incremental queries (val: %v)", valueName, value)
+						return
+					}
+					adds = append(adds, addition{append(labels, valueName), value})
+				}
+			}
+			for _, a := range adds {
+				key := strings.Join(a.labels, "\xff")
+				t, ok := totals[key]
+				if !ok {
+					t = &seriesTotal{Labels: a.labels}
+					totals[key] = t
+					st.Totals = append(st.Totals, t)
+				}
+				t.Value += a.value
+			}
+			if next != nil {
+				st.Watermark = next
+			}
+		}
+		metrics = make([]prometheus.Metric, 0, len(st.Totals))
+		for _, t := range st.Totals {
+			// totals of a former set of label columns
+			if len(t.Labels) != len(q.Labels)+1 {
+				continue
+			}
+			m, merr := q.newMetric(conn, t.Value, t.Labels[:len(q.Labels)], t.Labels[len(q.Labels)])
+			if merr != nil {
+				err = merr
+				return
+			}
+			metrics = append(metrics, m)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// selectsColumn reports whether the column name is a word of the query, so
+// that it may be one of its columns
+func selectsColumn(query, name string) bool {
+	name = strings.ToLower(name)
+	for i := 0; i < len(query); {
+		if !isIdentChar(query[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(query) && isIdentChar(query[i]) {
+			i++
+		}
+		if strings.ToLower(query[start:i]) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneState drops the states of the incremental queries of the job on the
+// connections it retired, e.g. hosts that vanished from DNS. Connections that
+// are only missing, e.g. because the discovery failed at startup, keep their
+// states, as do retired connections whose queries still run.
+func (j *Job) pruneState() {
+	j.connsMu.Lock()
+	var retired, running []*connection
+	for _, c := range j.retiredConns {
+		if c.isRunning() {
+			running = append(running, c)
+		} else {
+			retired = append(retired, c)
+		}
+	}
+	j.retiredConns = running
+	conns := j.conns
+	j.connsMu.Unlock()
+	if len(retired) == 0 {
+		return
+	}
+	keys := make(map[string]bool)
+	for _, q := range j.Queries {
+		if q == nil || q.Incremental == nil {
+			continue
+		}
+		for _, c := range retired {
+			keys[q.stateKey(c)] = true
+		}
+		// e.g. a host that vanished and came back
+		for _, c := range conns {
+			delete(keys, q.stateKey(c))
+		}
+	}
+	j.state.prune(func(key string) bool {
+		return !keys[key]
+	})
+}
+
+// pruneQueries drops the states of queries that aren't incremental queries
+// of the jobs anymore
+func (s *stateStore) pruneQueries(jobs []*Job) {
+	prefixes := make(map[string]bool)
+	for _, j := range jobs {
+		if j == nil {
+			continue
+		}
+		for _, q := range j.Queries {
+			if q != nil && q.Incremental != nil {
+				prefixes[statePrefix(j.Name, q.Name)] = true
+			}
+		}
+	}
+	s.prune(func(key string) bool {
+		for prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// hasIncremental reports whether any query of the jobs is incremental
+func (f *File) hasIncremental() bool {
+	for _, j := range f.Jobs {
+		if j == nil {
+			continue
+		}
+		for _, q := range j.Queries {
+			if q != nil && q.Incremental != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package exporter
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newIncrementalJob returns a job with the incremental query q summing v by
+// the label l, keeping its state in state.json in dir
+func newIncrementalJob(t *testing.T, dir string) *Job {
+	t.Helper()
+	exp := newTestExporter(t, dir, `
+state_file: state.json
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - name: q
+    help: h
+    labels: [l]
+    values: [v]
+    query: SELECT l, sum(v) AS v, max(id) AS id FROM t WHERE id > ? GROUP BY l
+    args: [{runtime: watermark}]
+    incremental: {watermark: id}
+`)
+	return exp.jobs[0]
+}
+
+// totals returns the totals of the state of key by their labels
+func totals(s *stateStore, key string) map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]float64)
+	if st, ok := s.queries[key]; ok {
+		for _, t := range st.Totals {
+			res[t.Labels[0]+"/"+t.Labels[1]] = t.Value
+		}
+	}
+	return res
+}
+
+func TestAccumulate(t *testing.T) {
+	j := newIncrementalJob(t, t.TempDir())
+	q, conn := j.Queries[0], j.connections()[0]
+	key := q.stateKey(conn)
+
+	if _, err := q.accumulate(conn, []map[string]interface{}{
+		{"l": "a", "v": int64(2), "id": int64(10)},
+		{"l": "b", "v": int64(3), "id": int64(10)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.accumulate(conn, []map[string]interface{}{
+		{"l": "a", "v": int64(1), "id": int64(12)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := totals(j.state, key), map[string]float64{"a/v": 3, "b/v": 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got totals %v, want %v", got, want)
+	}
+	if w := q.watermark(conn); w != int64(12) {
+		t.Fatalf("got watermark %v, want 12", w)
+	}
+
+	// a run is added completely or not at all
+	if _, err := q.accumulate(conn, []map[string]interface{}{
+		{"l": "a", "v": int64(5), "id": int64(14)},
+		{"l": "b", "v": int64(-1), "id": int64(14)},
+	}); err == nil {
+		t.Fatal("negative value was accumulated")
+	}
+	if got, want := totals(j.state, key), map[string]float64{"a/v": 3, "b/v": 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got totals %v after a failed run, want %v", got, want)
+	}
+	if w := q.watermark(conn); w != int64(12) {
+		t.Fatalf("got watermark %v after a failed run, want 12", w)
+	}
+
+	// rows without a watermark would be added again by every run
+	for _, id := range []interface{}{nil, "missing"} {
+		row := map[string]interface{}{"l": "a", "v": int64(5)}
+		if id != "missing" {
+			row["id"] = id
+		}
+		if _, err := q.accumulate(conn, []map[string]interface{}{
+			{"l": "b", "v": int64(1), "id": int64(16)},
+			row,
+		}); err == nil {
+			t.Fatalf("row with %v watermark was accumulated", id)
+		}
+	}
+	if got, want := totals(j.state, key), map[string]float64{"a/v": 3, "b/v": 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got totals %v after rows without a watermark, want %v", got, want)
+	}
+	if w := q.watermark(conn); w != int64(12) {
+		t.Fatalf("got watermark %v after rows without a watermark, want 12", w)
+	}
+
+	// e.g. the table was truncated, the run is discarded and the next one
+	// starts over
+	if _, err := q.accumulate(conn, []map[string]interface{}{
+		{"l": "a", "v": int64(7), "id": int64(4)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := totals(j.state, key), map[string]float64{"a/v": 3, "b/v": 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got totals %v after the watermark went back, want %v", got, want)
+	}
+	if w := q.watermark(conn); w != int64(0) {
+		t.Fatalf("got watermark %v after it went back, want the initial 0", w)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	dir := t.TempDir()
+	j := newIncrementalJob(t, dir)
+	q, conn := j.Queries[0], j.connections()[0]
+	if _, err := q.accumulate(conn, []map[string]interface{}{
+		{"l": "a", "v": 2.5, "id": "2024-01-01T00:00:00Z"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "state.json")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state file was written before the flush: %v", err)
+	}
+	if err := j.state.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.queries, j.state.queries) {
+		t.Fatalf("got state %v, want %v", s.queries, j.state.queries)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file was left behind: %v", err)
+	}
+
+	// unchanged state isn't written again
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.state.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("unchanged state was written: %v", err)
+	}
+}
+
+func TestPruneState(t *testing.T) {
+	j := newIncrementalJob(t, t.TempDir())
+	q, conn := j.Queries[0], j.connections()[0]
+	gone := &connection{driver: "sqlite", host: "y.db", database: "y.db", url: &url.URL{Scheme: "sqlite", Path: "y.db"}}
+	for _, c := range []*connection{conn, gone} {
+		if _, err := q.accumulate(c, []map[string]interface{}{{"l": "a", "v": 1, "id": 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.state.update("removed/q/sqlite://@x.db/x.db", func(*incrementalState) {})
+	j.state.update("b/q/sqlite://@x.db/x.db", func(*incrementalState) {})
+
+	// connections that are only missing keep their states
+	j.pruneState()
+	if _, ok := j.state.queries[q.stateKey(gone)]; !ok {
+		t.Fatal("state of a connection that was never retired was dropped")
+	}
+
+	// the states of other jobs are kept
+	j.connsMu.Lock()
+	j.conns = append(j.conns, gone)
+	j.connsMu.Unlock()
+	j.syncConnections(func(c *connection) bool { return c == gone }, nil)
+	j.pruneState()
+	if _, ok := j.state.queries[q.stateKey(gone)]; ok {
+		t.Error("state of a retired connection was kept")
+	}
+	for _, key := range []string{q.stateKey(conn), "removed/q/sqlite://@x.db/x.db", "b/q/sqlite://@x.db/x.db"} {
+		if _, ok := j.state.queries[key]; !ok {
+			t.Errorf("state %s was dropped", key)
+		}
+	}
+
+	// the jobs of the config don't have the other ones anymore
+	j.state.pruneQueries([]*Job{j})
+	if len(j.state.queries) != 1 {
+		t.Errorf("got states %v, want only %s", j.state.queries, q.stateKey(conn))
+	}
+}
+
+func TestFailedDiscoveryKeepsState(t *testing.T) {
+	dir := t.TempDir()
+	key := "a/q/postgres://u@10.0.0.1:5432/db"
+	state := `{"version": 1, "queries": {"` + key + `": {"watermark": {"kind": "int", "value": "7"}}}}`
+	if err := os.WriteFile(filepath.Join(dir, "state.json"), []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the host doesn't resolve, the job starts without connections
+	exp := newTestExporter(t, dir, `
+state_file: state.json
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://u@unresolvable.invalid:5432/db']
+  dns_sd: {}
+  queries:
+  - name: q
+    help: h
+    values: [v]
+    query: SELECT count(*) AS v, max(id) AS id FROM t WHERE id > $1
+    args: [{runtime: watermark}]
+    incremental: {watermark: id}
+`)
+	j := exp.jobs[0]
+	if n := len(j.connections()); n != 0 {
+		t.Fatalf("got %d connections, want none", n)
+	}
+	j.runOnce(0)
+
+	s, err := loadState(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []*stateStore{j.state, s} {
+		if w := st.watermark(key); w == nil || w.Value != "7" {
+			t.Errorf("got watermark %v, want 7", w)
+		}
+	}
+}
@@ -2,21 +2,29 @@ package exporter
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	_ "github.com/ClickHouse/clickhouse-go/v2" // register the ClickHouse driver
 	"github.com/cenkalti/backoff"
 	_ "github.com/denisenkom/go-mssqldb" // register the MS-SQL driver
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	_ "github.com/go-sql-driver/mysql" // register the MySQL driver
+	_ "github.com/jackc/pgx/v5/stdlib" // register the pgx driver
 	"github.com/jmoiron/sqlx"
-	_ "github.com/kshvakov/clickhouse" // register the ClickHouse driver
-	_ "github.com/lib/pq"              // register the PostgreSQL driver
+	_ "github.com/lib/pq" // register the PostgreSQL driver
 	"github.com/prometheus/client_golang/prometheus"
+	_ "modernc.org/sqlite" // register the SQLite driver
 )
 
 var (
@@ -26,15 +34,58 @@ var (
 )
 
 // Init will initialize the metric descriptors
-func (j *Job) Init(tracer opentracing.Tracer, logger *RotationLogger, queries map[string]string) error {
+func (j *Job) Init(tracer opentracing.Tracer, logger *RotationLogger) error {
 	if tracer == nil {
 		// No tracing found, use noop one.
 		tracer = &opentracing.NoopTracer{}
 	}
 
 	j.tracer = &tracer
+	j.stop = make(chan struct{})
 	j.Logger = newRotationLogger(logger, logger.maxMessages)
 	j.Logger.SetLogger(log.With(j.Logger.GetLogger(), "job", j.Name))
+	if j.AutoDiscoverDatabases != nil {
+		if err := j.AutoDiscoverDatabases.compile(); err != nil {
+			return fmt.Errorf("auto_discover_databases: %v", err)
+		}
+	}
+	j.shareTargetLabels()
+	if j.state == nil {
+		// jobs created without an exporter keep their state in memory
+		j.state, _ = loadState("")
+	}
+	for _, q := range j.Queries {
+		if q != nil {
+			q.readOnly = j.readOnly()
+			q.interval = j.Interval
+			q.job = j.Name
+			q.state = j.state
+		}
+	}
+	j.infoDesc = prometheus.NewDesc(
+		"sql_exporter_server_info",
+		"Version and role of the database server.",
+		append([]string{"driver", "host", "database", "user", "version", "role"}, j.targetLabels...),
+		prometheus.Labels{
+			"sql_job": j.Name,
+		},
+	)
+	j.roleDesc = prometheus.NewDesc(
+		"sql_exporter_server_is_replica",
+		"1 if the database server is a replica, 0 if it is a primary, detected on every run.",
+		append([]string{"driver", "host", "database", "user"}, j.targetLabels...),
+		prometheus.Labels{
+			"sql_job": j.Name,
+		},
+	)
+	j.breakerDesc = prometheus.NewDesc(
+		"sql_exporter_circuit_breaker_state",
+		"State of the circuit breaker of the connection: 0 closed, 1 open, 2 half-open.",
+		append([]string{"driver", "host", "database", "user"}, j.targetLabels...),
+		prometheus.Labels{
+			"sql_job": j.Name,
+		},
+	)
 	// register each query as an metric
 	for _, q := range j.Queries {
 		if q == nil {
@@ -43,12 +94,7 @@ func (j *Job) Init(tracer opentracing.Tracer, logger *RotationLogger, queries ma
 		}
 		q.Logger = newRotationLogger(j.Logger, logger.maxMessages)
 		q.Logger.SetLogger(log.With(q.Logger.GetLogger(), "query", q.Name))
-		if q.Query == "" && q.QueryRef != "" {
-			if qry, found := queries[q.QueryRef]; found {
-				q.Query = qry
-			}
-		}
-		if q.Query == "" {
+		if q.Query == "" && len(q.Variants) == 0 {
 			level.Warn(q.Logger).Log("msg", "Skipping empty query")
 			continue
 		}
@@ -58,17 +104,14 @@ func (j *Job) Init(tracer opentracing.Tracer, logger *RotationLogger, queries ma
 			// after the each round of collection this will be resized as necessary.
 			q.metrics = make(map[*connection][]prometheus.Metric, len(j.Queries))
 		}
-		// try to satisfy prometheus naming restrictions
-		name := MetricNameRE.ReplaceAllString("sql_"+q.Name, "")
-		help := q.Help
 		// prepare a new metrics descriptor
 		//
 		// the tricky part here is that the *order* of labels has to match the
 		// order of label values supplied to NewConstMetric later
 		q.desc = prometheus.NewDesc(
-			name,
-			help,
-			append(q.Labels, "driver", "host", "database", "user", "col"),
+			q.metricName(),
+			q.Help,
+			q.labelNames(),
 			prometheus.Labels{
 				"sql_job": j.Name,
 			},
@@ -82,16 +125,32 @@ func (j *Job) Init(tracer opentracing.Tracer, logger *RotationLogger, queries ma
 				"sql_query": q.Name,
 			},
 		)
-		q.Durations = prometheus.NewSummary(prometheus.SummaryOpts{
-			Name:       "sql_query_durations",
-			Help:       "SQL query durations.",
-			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		// only queries with min_interval reuse their cached result
+		if q.MinInterval > 0 {
+			q.cacheAgeDesc = prometheus.NewDesc(
+				"sql_query_cache_age_seconds",
+				"Seconds since the cached result of the query was updated.",
+				append(connLabelNames(), j.targetLabels...),
+				prometheus.Labels{
+					"sql_job":   j.Name,
+					"sql_query": q.Name,
+				},
+			)
+		}
+		buckets := j.DurationBuckets
+		if len(buckets) == 0 {
+			buckets = prometheus.DefBuckets
+		}
+		q.durations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                        "sql_query_duration_seconds",
+			Help:                        "SQL query duration by phase (connect, execute, fetch).",
+			Buckets:                     buckets,
+			NativeHistogramBucketFactor: j.NativeHistogramBucketFactor,
 			ConstLabels: prometheus.Labels{
 				"sql_job":   j.Name,
 				"sql_query": q.Name,
 			},
-		})
-		prometheus.MustRegister(q.Durations)
+		}, []string{"host", "database", "phase"})
 	}
 	return nil
 }
@@ -102,7 +161,7 @@ func (j *Job) Prepare() {
 		j.Logger = newRotationLogger(log.NewNopLogger(), 100)
 	}
 	// if there are no connection URLs for this job it can't be run
-	if j.Connections == nil {
+	if j.Connections == nil && j.ConnectionsFrom == nil {
 		level.Error(j.Logger).Log("msg", "No conenctions for job", "job", j.Name)
 		return
 	}
@@ -110,28 +169,173 @@ func (j *Job) Prepare() {
 	if j.conns == nil {
 		j.conns = make([]*connection, 0, len(j.Connections))
 	}
-	// parse the connection URLs and create an connection object for each
-	if len(j.conns) < len(j.Connections) {
-		for _, conn := range j.Connections {
-			u, err := url.Parse(conn)
+	// create an connection object for each connection of the config
+	if len(j.conns)+len(j.servers) < len(j.Connections) {
+		for k := range j.Connections {
+			conn, err := j.Connections[k].newConnection()
 			if err != nil {
-				level.Error(j.Logger).Log("msg", "Failed to parse URL", "url", conn, "err", err)
+				level.Error(j.Logger).Log("msg", "Failed to parse connection", "connection", k, "err", err)
+				continue
+			}
+			// with database or DNS discovery the connections only list the
+			// databases or hosts
+			if j.AutoDiscoverDatabases != nil || j.DNSSD != nil {
+				j.servers = append(j.servers, conn)
 				continue
 			}
-			user := ""
-			if u.User != nil {
-				user = u.User.Username()
+			j.conns = append(j.conns, conn)
+		}
+	}
+	// the databases are discovered once the job runs, Prepare doesn't
+	// connect to the servers
+	j.resolveHosts()
+	j.refreshTargets()
+}
+
+// dialects maps drivers to the driver whose SQL dialect they share, so that
+// e.g. the postgres packs, variants and system queries apply to pgx
+var dialects = map[string]string{
+	"pgx": "postgres",
+}
+
+// dialect returns the SQL dialect of the driver
+func dialect(driver string) string {
+	if d, ok := dialects[driver]; ok {
+		return d
+	}
+	return driver
+}
+
+// matchesDriver reports whether the connection uses the driver or its dialect
+func (c *connection) matchesDriver(driver string) bool {
+	return driver == c.driver || driver == dialect(c.driver)
+}
+
+// newConnection returns an unconnected connection to the URL u
+func newConnection(u *url.URL) *connection {
+	user := ""
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	host, database := u.Host, strings.TrimPrefix(u.Path, "/")
+	if u.Scheme == "sqlite" {
+		// the host of sqlite://data/x.db is the first directory of the path
+		host = sqlitePath(u)
+		database = host
+	}
+	// we expose some of the connection variables as labels, so we need to
+	// remember them
+	return &connection{
+		conn:     nil,
+		url:      u,
+		driver:   u.Scheme,
+		host:     host,
+		database: database,
+		user:     user,
+	}
+}
+
+// sqlitePath returns the database file of an SQLite URL. sqlite:///var/lib/x.db
+// is an absolute path, sqlite://x.db or sqlite://data/x.db a relative one.
+func sqlitePath(u *url.URL) string {
+	if u.Opaque != "" {
+		// sqlite:x.db
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+// sqliteDSN translates an SQLite URL to the DSN of the driver, a file: URI
+// with the options of the driver and SQLite, e.g.
+// file:x.db?mode=ro&_pragma=busy_timeout(5000). The driver ignores the
+// SQLite options of plain file paths.
+func sqliteDSN(u *url.URL) string {
+	dsn := "file:" + (&url.URL{Path: sqlitePath(u)}).EscapedPath()
+	if u.RawQuery == "" {
+		return dsn
+	}
+	return dsn + "?" + u.RawQuery
+}
+
+// connections returns the current connections of the job
+func (j *Job) connections() []*connection {
+	j.connsMu.Lock()
+	defer j.connsMu.Unlock()
+	return j.conns
+}
+
+// key identifies the connection, the same URL with other target labels is
+// another connection
+func (c *connection) key() string {
+	names := make([]string, 0, len(c.labels))
+	for name := range c.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+c.labels[name])
+	}
+	return c.url.String() + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// syncConnections replaces the connections of the job for which owned
+// returns true with the connections in want, mapped by their key. Existing
+// connections are kept along with their pools and cached metrics, the others
+// are retired.
+func (j *Job) syncConnections(owned func(*connection) bool, want map[string]*connection) (added, retired []*connection) {
+	j.connsMu.Lock()
+	// Collect may still range over the old slice, so build a new one
+	conns := make([]*connection, 0, len(j.conns)+len(want))
+	known := make(map[string]bool, len(want))
+	for _, c := range j.conns {
+		if owned(c) {
+			key := c.key()
+			if _, ok := want[key]; !ok || known[key] {
+				retired = append(retired, c)
+				continue
 			}
-			// we expose some of the connection variables as labels, so we need to
-			// remember them
-			j.conns = append(j.conns, &connection{
-				conn:     nil,
-				url:      u,
-				driver:   u.Scheme,
-				host:     u.Host,
-				database: strings.TrimPrefix(u.Path, "/"),
-				user:     user,
-			})
+			known[key] = true
+		}
+		conns = append(conns, c)
+	}
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		if !known[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		added = append(added, want[key])
+		conns = append(conns, want[key])
+	}
+	j.conns = conns
+	j.retiredConns = append(j.retiredConns, retired...)
+	j.connsMu.Unlock()
+
+	for _, c := range retired {
+		j.retire(c)
+	}
+	return added, retired
+}
+
+// retire closes a connection that was removed from the job and drops its
+// cached metrics
+func (j *Job) retire(c *connection) {
+	// a query still running on c must not cache its metrics after they were
+	// dropped here
+	c.mu.Lock()
+	c.retired = true
+	c.mu.Unlock()
+	c.close()
+	for _, q := range j.Queries {
+		if q == nil {
+			continue
+		}
+		q.forget(c)
+		if q.durations != nil {
+			q.durations.DeletePartialMatch(prometheus.Labels{"host": c.host, "database": c.database})
 		}
 	}
 }
@@ -139,43 +343,163 @@ func (j *Job) Prepare() {
 // Run the job
 func (j *Job) Run() {
 	level.Debug(j.Logger).Log("msg", "Starting")
+	if j.ConnectionsFrom != nil {
+		go j.watchTargets()
+	}
+	if j.DNSSD != nil {
+		go j.watchHosts()
+	}
+	if j.AutoDiscoverDatabases != nil {
+		// the first run needs the databases
+		j.discoverDatabases()
+		go j.watchDatabases()
+	}
 	// enter the run loop
-	// tries to run each query on each connection at approx the interval
+	// tries to run each query on each connection at approx the interval,
+	// failing connections are retried within the interval. The runs aren't
+	// waited for, so that a connection that is retried or hangs doesn't
+	// delay the others.
 	for {
-		bo := backoff.NewExponentialBackOff()
-		bo.MaxElapsedTime = j.Interval
-		if err := backoff.Retry(j.runOnce, bo); err != nil {
-			level.Error(j.Logger).Log("msg", "Failed to run", "err", err)
-		}
+		done := j.startRun(j.Interval)
+		go func() {
+			if err := <-done; err != nil {
+				level.Error(j.Logger).Log("msg", "Failed to run", "err", err)
+			}
+		}()
 		level.Debug(j.Logger).Log("msg", "Sleeping until next run", "sleep", j.Interval.String())
-		time.Sleep(j.Interval)
+		select {
+		case <-j.stop:
+			level.Debug(j.Logger).Log("msg", "Stopped")
+			return
+		case <-time.After(j.Interval):
+		}
 	}
 }
 
+// Stop ends Run and the discovery of the job once the current run finished
+func (j *Job) Stop() {
+	close(j.stop)
+}
+
 // RunOnce run the job once
 func (j *Job) RunOnce() {
-	if err := j.runOnce(); err != nil {
+	j.discoverDatabases()
+	if err := j.runOnce(0); err != nil {
 		level.Error(j.Logger).Log("msg", "Failed to run", "err", err)
 	}
 }
 
-func (j *Job) runOnceConnection(conn *connection, done chan int) {
+// runResult accounts the queries of a connection in a run of the job
+type runResult struct {
+	updated int      // queries that ran or were skipped
+	failed  []*Query // queries that still failed after the retries
+	skipped bool     // the circuit breaker is open
+}
+
+// runOnceConnection runs the queries on the connection unless its circuit
+// breaker is open. Queries that failed with the connection are retried with
+// backoff for up to retry, queries that succeeded are not run again.
+func (j *Job) runOnceConnection(conn *connection, retry time.Duration) runResult {
 	span := (*j.tracer).StartSpan("job.runOnceConnection")
 	span.SetTag("job.name", j.Name)
-	updated := 0
-	defer func() {
-		done <- updated
-		span.Finish()
-	}()
+	defer span.Finish()
+	res := runResult{failed: j.Queries}
+
+	if !conn.allow(time.Now()) {
+		level.Debug(j.Logger).Log("msg", "Skipping connection, circuit breaker is open", "host", conn.host, "db", conn.database)
+		res.failed, res.skipped = nil, true
+		return res
+	}
+	// a probe of a half-open breaker isn't retried
+	state, _ := conn.breakerState()
+	probe := state == breakerHalfOpen
+	ctx := ContextWithTracer(opentracing.ContextWithSpan(context.Background(), span), *j.tracer)
+	// the connection is up once a query ran on it, the later attempts only
+	// retry the failed queries
+	up := false
+	var lastErr error
+	run := func() error {
+		updated, failed, err := j.runConnection(ctx, conn, res.failed)
+		res.updated += updated
+		res.failed = failed
+		up = up || updated > 0
+		lastErr = err
+		if err != nil && conn.conn != nil && !connectionError(err) {
+			// the queries fail the same way when retried, e.g. with a
+			// syntax error
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	if retry <= 0 || probe {
+		run()
+	} else {
+		bo := backoff.NewExponentialBackOff()
+		bo.MaxElapsedTime = retry
+		backoff.Retry(run, bo)
+	}
+
+	// the breaker counts runs, not the attempts within a run. Only a
+	// connection that fails trips it, not the errors of its queries, e.g. a
+	// syntax error or a server version that's still unknown.
+	connFailed := lastErr != nil && (conn.conn == nil || connectionError(lastErr))
+	if up || len(res.failed) == 0 || !connFailed {
+		if conn.succeeded() {
+			level.Info(j.Logger).Log("msg", "Circuit breaker closed", "host", conn.host, "db", conn.database)
+		}
+		return res
+	}
+	if conn.failed(j, time.Now()) {
+		_, until := conn.breakerState()
+		level.Warn(j.Logger).Log("msg", "Circuit breaker opened", "err", lastErr, "host", conn.host, "db", conn.database, "probe_at", until)
+	}
+	return res
+}
+
+// connectionError reports whether err is a failure of the connection rather
+// than of the query, which is worth a retry. A query that timed out would
+// time out again.
+func connectionError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
 
+// runConnection runs the queries on the connection once. It returns the
+// number of queries that ran or were skipped, the queries that failed and
+// the last error.
+func (j *Job) runConnection(ctx context.Context, conn *connection, queries []*Query) (int, []*Query, error) {
 	// connect to DB if not connected already
 	if err := conn.connect(j); err != nil {
 		level.Warn(j.Logger).Log("msg", "Failed to connect", "err", err)
-		return
+		return 0, queries, err
 	}
 
-	ctx := ContextWithTracer(opentracing.ContextWithSpan(context.Background(), span), *j.tracer)
-	for _, q := range j.Queries {
+	// query variants depend on the server version, which only changes with a
+	// restart of the server. A failed detection is retried on the next run.
+	if _, ok := versionQueries[dialect(conn.driver)]; ok && conn.serverVersion() == nil {
+		if err := conn.detectVersion(conn.conn); err != nil {
+			level.Warn(j.Logger).Log("msg", "Failed to detect server version", "err", err, "host", conn.host, "db", conn.database)
+		}
+	}
+
+	// the role changes with a failover, so it's detected on every run
+	if _, ok := roleQueries[dialect(conn.driver)]; ok {
+		prev, err := conn.detectRole(conn.conn)
+		if err != nil {
+			level.Warn(j.Logger).Log("msg", "Failed to detect server role", "err", err, "host", conn.host, "db", conn.database)
+		} else if role := conn.serverRole(); prev != "" && prev != role {
+			level.Info(j.Logger).Log("msg", "Server role changed", "from", prev, "to", role, "host", conn.host, "db", conn.database)
+		}
+	}
+
+	updated := 0
+	var failed []*Query
+	var lastErr error
+	for _, q := range queries {
 		if q == nil {
 			continue
 		}
@@ -184,50 +508,156 @@ func (j *Job) runOnceConnection(conn *connection, done chan int) {
 			level.Warn(q.Logger).Log("msg", "Skipping query. Collector is nil")
 			continue
 		}
+		if !q.runsOn(conn) {
+			// queries of packs are only run on the drivers of the pack
+			updated++
+			continue
+		}
+		version := conn.serverVersion()
+		if _, ok := versionQueries[dialect(conn.driver)]; ok && version == nil && (q.MinVersion != "" || q.MaxVersion != "") {
+			// the query can't be skipped before the version is known
+			err := fmt.Errorf("server version unknown")
+			level.Warn(q.Logger).Log("msg", "Failed to run query", "err", err, "host", conn.host, "db", conn.database)
+			failed = append(failed, q)
+			lastErr = err
+			continue
+		}
+		if !version.within(q.MinVersion, q.MaxVersion) {
+			// skipping an incompatible query is not a failure
+			level.Debug(q.Logger).Log("msg", "Skipping query. Not supported by server version", "version", version, "host", conn.host, "db", conn.database)
+			updated++
+			continue
+		}
+		if role := conn.serverRole(); !q.runsOnRole(role) {
+			// drop the metrics of the previous role, e.g. the replication lag
+			// of a promoted replica
+			q.forget(conn)
+			level.Debug(q.Logger).Log("msg", "Skipping query. Not run on server role", "role", role, "host", conn.host, "db", conn.database)
+			updated++
+			continue
+		}
+		if q.fresh(conn, time.Now()) {
+			level.Debug(q.Logger).Log("msg", "Skipping query. Cached result is fresh", "min_interval", q.MinInterval, "host", conn.host, "db", conn.database)
+			updated++
+			continue
+		}
 		level.Debug(q.Logger).Log("msg", "Running Query")
 		// execute the query on the connection
 		if err := q.Run(ctx, conn); err != nil {
-			level.Warn(q.Logger).Log("msg", "Failed to run query", "err", err)
+			level.Warn(q.Logger).Log("msg", "Failed to run query", "err", err, "host", conn.host, "db", conn.database)
+			failed = append(failed, q)
+			lastErr = err
 			continue
 		}
 		level.Debug(q.Logger).Log("msg", "Query finished")
 		updated++
 	}
+	return updated, failed, lastErr
 }
 
-func (j *Job) runOnce() error {
-	doneChan := make(chan int, len(j.conns))
+// runOnce runs the queries on all connections in parallel and waits for
+// them, failed queries are retried for up to retry
+func (j *Job) runOnce(retry time.Duration) error {
+	return <-j.startRun(retry)
+}
+
+// startRun starts running the queries on all connections in parallel,
+// failed queries are retried for up to retry. A connection still busy with
+// its previous run is skipped. The returned channel receives the result once
+// all runs finished.
+func (j *Job) startRun(retry time.Duration) <-chan error {
+	conns := j.connections()
+	doneChan := make(chan runResult, len(conns))
 
 	// execute queries for each connection in parallel
-	for _, conn := range j.conns {
-		go j.runOnceConnection(conn, doneChan)
+	started, busy := 0, 0
+	for _, conn := range conns {
+		if !conn.startRun() {
+			level.Warn(j.Logger).Log("msg", "Skipping connection. The previous run didn't finish", "host", conn.host, "db", conn.database)
+			busy++
+			continue
+		}
+		started++
+		go func(conn *connection) {
+			res := j.runOnceConnection(conn, retry)
+			conn.endRun()
+			doneChan <- res
+		}(conn)
 	}
+	result := make(chan error, 1)
+	go func() {
+		result <- j.finishRun(doneChan, started, busy)
+	}()
+	return result
+}
 
-	// connections now run in parallel, wait for and collect results
-	updated := 0
-	for range j.conns {
-		updated += <-doneChan
+// finishRun waits for the started runs of the connections and accounts them
+func (j *Job) finishRun(doneChan chan runResult, started, busy int) error {
+	conns := started + busy
+	updated, failedConns, failedQueries, skipped := 0, 0, 0, busy
+	for i := 0; i < started; i++ {
+		res := <-doneChan
+		updated += res.updated
+		if len(res.failed) > 0 {
+			failedConns++
+			failedQueries += len(res.failed)
+		}
+		if res.skipped {
+			skipped++
+		}
+	}
+	if failedConns > 0 {
+		level.Warn(j.Logger).Log("msg", "Some queries failed", "connections", conns, "failed_connections", failedConns, "failed_queries", failedQueries, "skipped_connections", skipped)
+	}
+
+	// the state of incremental queries is saved once per run, without the
+	// connections retired in the meantime
+	j.pruneState()
+	if err := j.state.flush(); err != nil {
+		level.Warn(j.Logger).Log("msg", "Failed to save the state file", "err", err)
 	}
 
-	if updated < 1 {
+	// connections that are all still busy with the previous run aren't an
+	// error of this one
+	if updated < 1 && (started > 0 || conns == 0) {
 		return fmt.Errorf("zero queries ran")
 	}
 	return nil
 }
 
+// startRun marks the connection as running, it returns false if the
+// previous run didn't finish yet
+func (c *connection) startRun() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running {
+		return false
+	}
+	c.running = true
+	return true
+}
+
+func (c *connection) endRun() {
+	c.mu.Lock()
+	c.running = false
+	c.mu.Unlock()
+}
+
 func (c *connection) connect(job *Job) error {
 	// already connected
 	if c.conn != nil {
 		return nil
 	}
-	dsn := c.url.String()
-	switch c.url.Scheme {
-	case "mysql":
-		dsn = strings.TrimPrefix(dsn, "mysql://")
-	case "clickhouse":
-		dsn = "tcp://" + strings.TrimPrefix(dsn, "clickhouse://")
+	dsn, err := c.dsn()
+	if err != nil {
+		return err
+	}
+	var conn *sqlx.DB
+	if t := c.tlsConfig(job); t != nil {
+		conn, err = c.openTLS(dsn, t)
+	} else {
+		conn, err = sqlx.Connect(c.driver, dsn)
 	}
-	conn, err := sqlx.Connect(c.url.Scheme, dsn)
 	if err != nil {
 		return err
 	}
@@ -251,3 +681,25 @@ func (c *connection) connect(job *Job) error {
 	c.conn = conn
 	return nil
 }
+
+// isRunning reports whether the queries run on the connection
+func (c *connection) isRunning() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
+
+// isRetired reports whether the connection was removed from its job
+func (c *connection) isRetired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.retired
+}
+
+// close closes the connection pool
+func (c *connection) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.releaseTLS()
+}
@@ -0,0 +1,241 @@
+package exporter
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gatherAndCompare fails unless the metrics of exp named names are want,
+// which may refer to the test directory as DIR
+func gatherAndCompare(t *testing.T, exp *Exporter, dir string, want string, names ...string) {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(exp); err != nil {
+		t.Fatal(err)
+	}
+	want = strings.ReplaceAll(want, "DIR", dir)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVariantsOnly(t *testing.T) {
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - name: q
+    help: h
+    values: [v]
+    variants:
+    - {driver: postgres, query: SELECT 1 AS v}
+    - {driver: sqlite, query: SELECT 2 AS v}
+`)
+	if err := exp.jobs[0].runOnce(0); err != nil {
+		t.Fatal(err)
+	}
+	gatherAndCompare(t, exp, dir, `
+# HELP sql_q h
+# TYPE sql_q gauge
+sql_q{col="v",database="DIR/x.db",driver="sqlite",host="DIR/x.db",sql_job="a",user=""} 2
+`, "sql_q")
+}
+
+func TestUnknownServerVersion(t *testing.T) {
+	query := versionQueries["sqlite"]
+	versionQueries["sqlite"] = "SELECT 'unknown'"
+	defer func() { versionQueries["sqlite"] = query }()
+
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - {name: any, help: h, values: [v], query: SELECT 1 AS v}
+  - {name: new, help: h, values: [v], query: SELECT 1 AS v, min_version: '3'}
+`)
+	j := exp.jobs[0]
+	ctx := ContextWithTracer(context.Background(), *j.tracer)
+	updated, failed, err := j.runConnection(ctx, j.connections()[0], j.Queries)
+	if updated != 1 || len(failed) != 1 || failed[0].Name != "new" || err == nil {
+		t.Fatalf("got %d updated, failed %v, error %v; want the version gated query to fail", updated, failed, err)
+	}
+
+	// the detection is retried on the next run
+	versionQueries["sqlite"] = query
+	updated, failed, err = j.runConnection(ctx, j.connections()[0], failed)
+	if updated != 1 || len(failed) != 0 || err != nil {
+		t.Fatalf("got %d updated, failed %v, error %v", updated, failed, err)
+	}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	for _, tc := range []struct {
+		url, host, dsn string
+	}{
+		{"sqlite://data/x.db", "data/x.db", "file:data/x.db"},
+		{"sqlite:x.db?mode=ro", "x.db", "file:x.db?mode=ro"},
+		{"sqlite:///var/lib/x.db?_pragma=busy_timeout(5000)", "/var/lib/x.db", "file:/var/lib/x.db?_pragma=busy_timeout(5000)"},
+		{"sqlite:///var/lib/a%20b%3F.db", "/var/lib/a b?.db", "file:/var/lib/a%20b%3F.db"},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newConnection(u)
+		if c.host != tc.host || c.database != tc.host {
+			t.Errorf("%s: got host %q and database %q, want %q", tc.url, c.host, c.database, tc.host)
+		}
+		if dsn := sqliteDSN(u); dsn != tc.dsn {
+			t.Errorf("%s: got DSN %q, want %q", tc.url, dsn, tc.dsn)
+		}
+	}
+}
+
+func TestSQLiteReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.db")
+	db, err := sqlx.Connect("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MustExec("CREATE TABLE t (v INTEGER)")
+	db.Close()
+
+	u, err := url.Parse("sqlite://" + path + "?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn, err := newConnection(u).dsn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = sqlx.Connect("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("SELECT count(*) FROM t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO t VALUES (1)"); err == nil {
+		t.Fatal("mode=ro connection wrote to the database")
+	}
+}
+
+func TestRetryConnectionErrors(t *testing.T) {
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+  - {name: broken, help: h, values: [v], query: SELECT 1 AS v FROM missing}
+`)
+	// the broken query isn't retried, that would take the whole retry time
+	start := time.Now()
+	if err := exp.jobs[0].runOnce(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("run took %v, the query error was retried", d)
+	}
+
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{errors.New(`near "SELEKT": syntax error`), false},
+		{context.DeadlineExceeded, false},
+	} {
+		if got := connectionError(tc.err); got != tc.want {
+			t.Errorf("%v: got connection error %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestHungConnectionDoesNotDelayOthers(t *testing.T) {
+	// a server that accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hung := make(chan net.Conn, 100)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			hung <- c
+		}
+	}()
+	defer func() {
+		for {
+			select {
+			case c := <-hung:
+				c.Close()
+			default:
+				return
+			}
+		}
+	}()
+
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 200ms
+  connections:
+  - 'sqlite://DIR/x.db'
+  - 'postgres://user@`+l.Addr().String()+`/db?sslmode=disable&connect_timeout=5'
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v}
+`)
+	j := exp.jobs[0]
+	healthy, q := j.connections()[0], j.Queries[0]
+	go j.Run()
+	defer j.Stop()
+
+	// the healthy connection keeps its interval while the other one hangs
+	var runs []time.Time
+	for end := time.Now().Add(time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+		q.Lock()
+		last, ok := q.lastRun[healthy]
+		q.Unlock()
+		if ok && (len(runs) == 0 || last.After(runs[len(runs)-1])) {
+			runs = append(runs, last)
+		}
+	}
+	if len(runs) < 3 {
+		t.Fatalf("the healthy connection ran %d times in a second, want at least 3", len(runs))
+	}
+	for i := 1; i < len(runs); i++ {
+		if gap := runs[i].Sub(runs[i-1]); gap > 400*time.Millisecond {
+			t.Errorf("run %d of the healthy connection was delayed by %v", i, gap)
+		}
+	}
+}
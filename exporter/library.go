@@ -0,0 +1,298 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// QueryLibrary holds the reusable queries shared by all jobs. An entry is
+// either a full query definition or just its SQL text. Jobs reference
+// entries with `use` (the full definition) or `query_ref` (the SQL only).
+type QueryLibrary map[string]*Query
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (l *QueryLibrary) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: queries must be a map", value.Line)}}
+	}
+	lib := make(QueryLibrary, len(value.Content)/2)
+	var errs []string
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		name, def := value.Content[i].Value, value.Content[i+1]
+		q := &Query{}
+		if def.Kind == yaml.ScalarNode {
+			q.Query = def.Value
+		} else if err := decodeStrict(def, q); err != nil {
+			typeErr, ok := err.(*yaml.TypeError)
+			if !ok {
+				return err
+			}
+			errs = append(errs, typeErr.Errors...)
+		}
+		lib[name] = q
+	}
+	*l = lib
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+	return nil
+}
+
+// queryParams is passed to the templates of library queries
+type queryParams struct {
+	Params map[string]string
+}
+
+// resolveQueries completes every job query referencing the library
+func (f *File) resolveQueries(errs *ConfigErrors) {
+	names := make([]string, 0, len(f.Queries))
+	for name := range f.Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if q := f.Queries[name]; q.Use != "" || q.QueryRef != "" {
+			errs.add(f.queriesSrc[name].at("queries."+name), "library query %q must not reference other queries", name)
+		}
+	}
+	for _, j := range f.Jobs {
+		if j == nil {
+			continue
+		}
+		for k, q := range j.Queries {
+			if q == nil {
+				continue
+			}
+			qpath := fmt.Sprintf("queries[%d]", k)
+			switch {
+			case q.Use != "" && q.QueryRef != "":
+				errs.add(j.at(qpath+".use"), "job %q: query %q has both use and query_ref", j.Name, q.Name)
+			case q.Query != "" && q.QueryRef != "":
+				errs.add(j.at(qpath+".query_ref"), "job %q: query %q has both query and query_ref", j.Name, q.Name)
+			case (q.Query != "" || len(q.Variants) > 0) && q.Use != "":
+				errs.add(j.at(qpath+".use"), "job %q: query %q has both query and use", j.Name, q.Name)
+			case q.Use != "":
+				lib, ok := f.Queries[q.Use]
+				if !ok {
+					errs.add(j.at(qpath+".use"), "job %q: query %q uses unknown query %q", j.Name, q.Name, q.Use)
+					continue
+				}
+				if err := q.use(lib); err != nil {
+					errs.add(j.at(qpath+".params"), "job %q: query %q: %v", j.Name, q.Use, err)
+				}
+			case q.QueryRef != "":
+				lib, ok := f.Queries[q.QueryRef]
+				if !ok {
+					errs.add(j.at(qpath+".query_ref"), "job %q: query %q references unknown query %q", j.Name, q.Name, q.QueryRef)
+					continue
+				}
+				// the SQL is taken as it is, only use renders templates
+				if len(q.Params) > 0 {
+					errs.add(j.at(qpath+".params"), "job %q: query %q: params only apply to use, not to query_ref", j.Name, q.Name)
+				}
+				q.Query = lib.Query
+				if len(q.Variants) == 0 && len(lib.Variants) > 0 {
+					q.Variants = make([]QueryVariant, len(lib.Variants))
+					copy(q.Variants, lib.Variants)
+				}
+			case len(q.Params) > 0:
+				errs.add(j.at(qpath+".params"), "job %q: query %q has params but no use", j.Name, q.Name)
+			}
+		}
+	}
+}
+
+// use completes q with the library query lib. Fields set in q take
+// precedence, templates are rendered with q.Params.
+func (q *Query) use(lib *Query) error {
+	var err error
+	render := func(s string) string {
+		if err != nil {
+			return s
+		}
+		r, rerr := q.render(s)
+		if rerr != nil {
+			err = rerr
+			return s
+		}
+		return r
+	}
+	if q.Name == "" {
+		q.Name = lib.Name
+	}
+	if q.Help == "" {
+		q.Help = lib.Help
+	}
+	// slices, maps and pointers are copied, so that the queries of different
+	// jobs never share them with each other or the library
+	if len(q.Labels) == 0 {
+		q.Labels = append([]string(nil), lib.Labels...)
+	}
+	if len(q.Values) == 0 {
+		q.Values = append([]string(nil), lib.Values...)
+	}
+	if q.MinVersion == "" && q.MaxVersion == "" {
+		q.MinVersion, q.MaxVersion = lib.MinVersion, lib.MaxVersion
+	}
+	if q.RunOn == "" {
+		q.RunOn = lib.RunOn
+	}
+	if q.Type == "" {
+		q.Type = lib.Type
+	}
+	if q.MinInterval == 0 {
+		q.MinInterval = lib.MinInterval
+	}
+	if len(q.Args) == 0 {
+		q.Args = append([]QueryArg(nil), lib.Args...)
+	}
+	if len(q.AllowProcedures) == 0 {
+		q.AllowProcedures = append([]string(nil), lib.AllowProcedures...)
+	}
+	if q.Incremental == nil && lib.Incremental != nil {
+		inc := *lib.Incremental
+		q.Incremental = &inc
+	}
+	if len(q.ResultSets) == 0 && len(lib.ResultSets) > 0 {
+		q.ResultSets = make([]*ResultSet, len(lib.ResultSets))
+		for i, rs := range lib.ResultSets {
+			q.ResultSets[i] = rs.clone()
+		}
+	}
+	if len(q.PreSQL) == 0 && len(lib.PreSQL) > 0 {
+		// rendered in place like the variants
+		q.PreSQL = make([]string, len(lib.PreSQL))
+		copy(q.PreSQL, lib.PreSQL)
+	}
+	if len(q.Variants) == 0 && len(lib.Variants) > 0 {
+		// the variants are rendered in place, don't touch the library
+		q.Variants = make([]QueryVariant, len(lib.Variants))
+		copy(q.Variants, lib.Variants)
+	}
+	q.Name = render(q.Name)
+	q.Help = render(q.Help)
+	q.Query = render(lib.Query)
+	for i := range q.Variants {
+		q.Variants[i].Query = render(q.Variants[i].Query)
+	}
+	for i := range q.PreSQL {
+		q.PreSQL[i] = render(q.PreSQL[i])
+	}
+	return err
+}
+
+// render executes text as template with the params of the query
+func (q *Query) render(text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := template.New(q.Use + q.QueryRef).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, queryParams{Params: q.Params}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// decodeStrict decodes n into out and reports unknown fields like a decoder
+// with KnownFields enabled, which yaml.Node.Decode does not support
+func decodeStrict(n *yaml.Node, out interface{}) error {
+	errs := unknownFields(n, reflect.TypeOf(out))
+	if err := n.Decode(out); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return err
+		}
+		errs = append(errs, typeErr.Errors...)
+	}
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+	return nil
+}
+
+// unknownFields walks n along the type t and returns an error message for
+// every mapping key without a matching struct field
+func unknownFields(n *yaml.Node, t reflect.Type) []string {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	// types with their own unmarshaler check their fields themselves
+	if t.Implements(unmarshalerType) || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var errs []string
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return nil
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			field, ok := fields[key.Value]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("line %d: field %s not found in type %s", key.Line, key.Value, t))
+				continue
+			}
+			errs = append(errs, unknownFields(n.Content[i+1], field.Type)...)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for _, c := range n.Content {
+			errs = append(errs, unknownFields(c, t.Elem())...)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 1; i < len(n.Content); i += 2 {
+			errs = append(errs, unknownFields(n.Content[i], t.Elem())...)
+		}
+	}
+	return errs
+}
+
+// yamlFields returns the fields of the struct type t by their YAML key
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		inline := false
+		for _, opt := range tag[1:] {
+			inline = inline || opt == "inline"
+		}
+		if inline {
+			for name, inner := range yamlFields(f.Type) {
+				fields[name] = inner
+			}
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
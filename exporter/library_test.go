@@ -0,0 +1,116 @@
+package exporter
+
+import (
+	"testing"
+)
+
+func TestResolveQueries(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Read(writeTestConfig(t, dir, `
+queries:
+  braces: "SELECT '{{' AS v"
+  versioned:
+    query: SELECT 1 AS v
+    variants:
+    - {driver: postgres, query: SELECT 2 AS v}
+  tables:
+    name: "{{ .Params.schema }}_tables"
+    help: Tables of {{ .Params.schema }}
+    values: [v]
+    query: SELECT count(*) AS v FROM tables WHERE schema = '{{ .Params.schema }}'
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://x.db']
+  queries:
+  - {name: braces, help: h, values: [v], query_ref: braces}
+  - {name: versioned, help: h, values: [v], query_ref: versioned}
+  - {use: tables, params: {schema: billing}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs := f.Jobs[0].Queries
+	if qs[0].Query != "SELECT '{{' AS v" {
+		t.Errorf("query_ref rendered the SQL: %q", qs[0].Query)
+	}
+	if qs[1].Query != "SELECT 1 AS v" || len(qs[1].Variants) != 1 || qs[1].Variants[0].Query != "SELECT 2 AS v" {
+		t.Errorf("query_ref didn't take the variants: %q %v", qs[1].Query, qs[1].Variants)
+	}
+	if qs[2].Name != "billing_tables" || qs[2].Help != "Tables of billing" ||
+		qs[2].Query != "SELECT count(*) AS v FROM tables WHERE schema = 'billing'" {
+		t.Errorf("use didn't render the templates: %q %q %q", qs[2].Name, qs[2].Help, qs[2].Query)
+	}
+
+	checkConfig(t, `
+queries:
+  plain: SELECT 1 AS v
+  tables: {help: h, values: [v], query: "SELECT '{{ .Params.schema }}' AS v"}
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://x.db']
+  queries:
+  - {name: q, help: h, values: [v], query_ref: plain, params: {schema: x}}
+  - {name: r, use: tables}
+  - {name: s, help: h, values: [v], query: SELECT 1, params: {schema: x}}
+`,
+		`c.yml:10: job "a": query "q": params only apply to use, not to query_ref`,
+		`c.yml:11: job "a": query "tables": template: tables:1:18: executing "tables" at <.Params.schema>: map has no entry for key "schema"`,
+		`c.yml:12: job "a": query "s" has params but no use`,
+	)
+}
+
+func TestUseCopiesLibrary(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Read(writeTestConfig(t, dir, `
+queries:
+  events:
+    help: h
+    labels: [kind]
+    values: [n]
+    query: SELECT kind, count(*) AS n, max(id) AS last_id FROM events WHERE id > ? GROUP BY kind
+    args: [{runtime: watermark}]
+    incremental: {watermark: last_id}
+  sets:
+    help: h
+    labels: [kind]
+    values: [n]
+    query: SELECT 'a' AS kind, 1 AS n; SELECT 'b' AS k, 2 AS n
+    result_sets: [{}, {labels: {kind: k}}]
+jobs:
+- name: a
+  interval: 1m
+  read_only: false
+  connections: ['sqlite://x.db']
+  queries:
+  - {name: events, use: events}
+  - {name: sets, use: sets}
+- name: b
+  interval: 1m
+  read_only: false
+  connections: ['sqlite://x.db']
+  queries:
+  - {name: events, use: events}
+  - {name: sets, use: sets}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := f.Jobs[0].Queries, f.Jobs[1].Queries
+	a[0].Labels[0] = "changed"
+	a[0].Values[0] = "changed"
+	a[0].Args[0].Runtime = "changed"
+	a[0].Incremental.Watermark = "changed"
+	a[1].ResultSets[1].Labels["kind"] = "changed"
+	for owner, q := range map[string]*Query{"job b": b[0], "library": f.Queries["events"]} {
+		if q.Labels[0] != "kind" || q.Values[0] != "n" || q.Args[0].Runtime != argWatermark || q.Incremental.Watermark != "last_id" {
+			t.Errorf("%s shares the query fields of job a: %v %v %v %+v", owner, q.Labels, q.Values, q.Args, q.Incremental)
+		}
+	}
+	for owner, q := range map[string]*Query{"job b": b[1], "library": f.Queries["sets"]} {
+		if q.ResultSets[1].Labels["kind"] != "k" {
+			t.Errorf("%s shares the result sets of job a: %v", owner, q.ResultSets[1].Labels)
+		}
+	}
+}
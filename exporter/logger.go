@@ -34,6 +34,8 @@ func newRotationLogger(logger log.Logger, maxMessages uint) *RotationLogger {
 
 // Log - save message to histiry, count errors and pass message to next logger
 func (rl *RotationLogger) Log(keyvals ...interface{}) error {
+	// the connections of a job log concurrently
+	rl.mu.Lock()
 	for i := 0; i < len(keyvals); i += 2 {
 		if keyvals[i] == level.Key() {
 			if keyvals[i+1] == level.WarnValue() || keyvals[i+1] == level.ErrorValue() {
@@ -44,10 +46,18 @@ func (rl *RotationLogger) Log(keyvals ...interface{}) error {
 			}
 		}
 	}
+	rl.mu.Unlock()
 	rl.addToHistory(keyvals...)
 	return rl.next.Log(keyvals...)
 }
 
+// errors returns the number of warnings and errors logged
+func (rl *RotationLogger) errors() uint {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.errorCounter
+}
+
 // GetHistory return last maxMessages messages
 func (rl *RotationLogger) GetHistory() []string {
 	rl.mu.Lock()
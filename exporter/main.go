@@ -22,7 +22,7 @@ import (
 	"github.com/uber/jaeger-client-go"
 	"github.com/uber/jaeger-client-go/config"
 	ozonTracing "gitlab.ozon.ru/platform/tracer-go"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 const indexPage string = `<html>
@@ -66,6 +66,30 @@ const indexPage string = `<html>
 		</tr>
 	{{end}}
 {{end}}
+</table>
+<h2>Connections</h2>
+<table border='1'><tr><th>Job</th><th>Driver</th><th>Host</th><th>Database</th><th>Circuit Breaker</th><th>Failures</th><th>Next Probe</th></tr>
+{{range .jobs}}
+	{{$job := .}}
+	{{range .ConnectionStates}}
+		<tr>
+			<td>{{$job.Name}}</td>
+			<td>{{.Driver}}</td>
+			<td>{{.Host}}</td>
+			<td>{{.Database}}</td>
+			<td>
+				{{if eq .Breaker "closed"}}
+				{{.Breaker}}
+				{{else}}
+				<strong>{{.Breaker}}</strong>
+				{{end}}
+			</td>
+			<td>{{.Failures}}</td>
+			<td>{{.ProbeAt}}</td>
+		</tr>
+	{{end}}
+{{end}}
+</table>
 </body>
 </html>`
 
@@ -174,7 +198,7 @@ const jobTestPageTemplate string = `<html>
 <div class="form-group">
 	<label for="query">Query</label>
 	<textarea rows=3 class="form-control" name="query.query" id="query" placeholder="sql statement"></textarea>
-	<small id="queryHelp" class="form-text text-muted">Query is the SQL query that is run unalterted on the each of the connections for this job.</small>
+	<small id="queryHelp" class="form-text text-muted">Query is the SQL query that is run unalterted on the each of the connections for this job. It runs in a read-only transaction, statements that write (INSERT, UPDATE, DROP, ...) are rejected.</small>
 </div>
 <button type="submit" class="btn btn-primary">Submit</button>
 </form>
@@ -203,11 +227,15 @@ func jobTestPageHandler(w http.ResponseWriter, r *http.Request) {
 		Values: strings.Split(r.Form.Get("query.values"), " "),
 		Query:  r.Form.Get("query.query"),
 	}
+	var connections []Connection
+	for _, u := range strings.Split(r.Form.Get("connections"), " ") {
+		connections = append(connections, Connection{URL: u})
+	}
 	interval, _ := time.ParseDuration(r.Form.Get("interval"))
 	job := &Job{
 		Name:        r.Form.Get("name"),
 		Interval:    interval,
-		Connections: strings.Split(r.Form.Get("connections"), " "),
+		Connections: connections,
 		Queries:     []*Query{query},
 	}
 	logger := log.NewJSONLogger(os.Stdout)
@@ -217,7 +245,7 @@ func jobTestPageHandler(w http.ResponseWriter, r *http.Request) {
 	)
 	expLogger := newRotationLogger(logger, 100)
 	tracer := opentracing.GlobalTracer()
-	job.Init(tracer, expLogger, make(map[string]string))
+	job.Init(tracer, expLogger)
 	job.Prepare()
 	checkExporter := &Exporter{
 		jobs:   []*Job{job},
@@ -255,8 +283,8 @@ func main() {
 		showVersion   = flag.Bool("version", false, "Print version information.")
 		listenAddress = flag.String("web.listen-address", ":9237", "Address to listen on for web interface and telemetry.")
 		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		configFile    = flag.String("config.file", os.Getenv("CONFIG"), "SQL Exporter configuration file name.")
-		configCheck   = flag.Bool("config.check", false, "Check configuration file structure.")
+		configFile    = flag.String("config.file", os.Getenv("CONFIG"), "SQL Exporter configuration file, directory or glob pattern.")
+		configCheck   = flag.Bool("config.check", false, "Check configuration file structure and semantics.")
 		check         = flag.Bool("check", false, "Check exporter, jobs and queries.")
 		historyLimit  = flag.Uint("history.limit", 100, "History limit for jobs/query logs in web-UI.")
 	)
@@ -317,6 +345,10 @@ func main() {
 
 	exporter, err := NewExporter(tracer, expLogger, *configFile)
 	if err != nil {
+		if *configCheck {
+			// list every problem on its own line
+			fmt.Fprintln(os.Stderr, err)
+		}
 		level.Error(logger).Log("msg", "Error starting exporter", "err", err)
 		os.Exit(1)
 	}
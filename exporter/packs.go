@@ -0,0 +1,129 @@
+package exporter
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// packFiles are the built-in query packs, one file per pack
+//
+//go:embed packs/*.yml
+var packFiles embed.FS
+
+// pack is a versioned set of queries for some drivers. Jobs enable packs
+// with `packs: [postgres_core]`, optionally pinned to a version with
+// `postgres_core@1`.
+type pack struct {
+	Version int      `yaml:"version"`
+	Drivers []string `yaml:"drivers"`
+	Queries []*Query `yaml:"queries"`
+}
+
+// packNames returns the names of all built-in packs
+func packNames() []string {
+	entries, err := packFiles.ReadDir("packs")
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), path.Ext(e.Name())))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadPack parses the built-in pack name. Every call returns new queries as
+// they hold the state of the job they are added to.
+func loadPack(name string) (*pack, error) {
+	buf, err := packFiles.ReadFile("packs/" + name + ".yml")
+	if err != nil {
+		return nil, fmt.Errorf("unknown pack %q, known packs are %s", name, strings.Join(packNames(), ", "))
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(buf, &root); err != nil {
+		return nil, fmt.Errorf("pack %q: %v", name, err)
+	}
+	p := &pack{}
+	if len(root.Content) > 0 {
+		if err := decodeStrict(root.Content[0], p); err != nil {
+			return nil, fmt.Errorf("pack %q: %v", name, err)
+		}
+	}
+	for _, q := range p.Queries {
+		if q != nil {
+			q.drivers = p.Drivers
+		}
+	}
+	return p, nil
+}
+
+// resolvePacks adds the queries of the packs enabled by each job
+func (f *File) resolvePacks(errs *ConfigErrors) {
+	for _, j := range f.Jobs {
+		if j == nil {
+			continue
+		}
+		for k, ref := range j.Packs {
+			pos := j.at(fmt.Sprintf("packs[%d]", k))
+			name, pin, pinned := strings.Cut(ref, "@")
+			p, err := loadPack(name)
+			if err != nil {
+				errs.add(pos, "job %q: %v", j.Name, err)
+				continue
+			}
+			if pinned {
+				version, err := strconv.Atoi(strings.TrimPrefix(pin, "v"))
+				if err != nil {
+					errs.add(pos, "job %q: invalid version %q of pack %q", j.Name, pin, name)
+					continue
+				}
+				if version != p.Version {
+					errs.add(pos, "job %q: pack %q is at version %d, not %d", j.Name, name, p.Version, version)
+					continue
+				}
+			}
+			for _, q := range p.Queries {
+				if q == nil {
+					continue
+				}
+				if j.hasQuery(q.Name) {
+					// e.g. db_sizes is part of the core pack of every driver
+					errs.add(pos, "job %q: query %q of pack %q is already defined, enable packs of different drivers in separate jobs", j.Name, q.Name, name)
+					continue
+				}
+				j.Queries = append(j.Queries, q)
+			}
+		}
+	}
+}
+
+// hasQuery reports whether the job has a query named name
+func (j *Job) hasQuery(name string) bool {
+	for _, q := range j.Queries {
+		if q != nil && q.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runsOn reports whether q may run on the connection, queries of packs are
+// limited to the drivers of the pack
+func (q *Query) runsOn(conn *connection) bool {
+	if len(q.drivers) == 0 {
+		return true
+	}
+	for _, d := range q.drivers {
+		if conn.matchesDriver(d) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,11 +2,14 @@ package exporter
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/jmoiron/sqlx"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 )
@@ -28,53 +31,243 @@ func (q *Query) Run(ctx context.Context, conn *connection) error {
 	if q.desc == nil {
 		return fmt.Errorf("metrics descriptor is nil")
 	}
-	if q.Query == "" {
-		return fmt.Errorf("query is empty")
-	}
 	if conn == nil || conn.conn == nil {
 		return fmt.Errorf("db connection not initialized (should not happen)")
 	}
-	// execute query
+	run := time.Now()
+	query, err := q.queryFor(conn)
+	if err != nil {
+		return err
+	}
+	args, err := q.args(conn, run)
+	if err != nil {
+		return err
+	}
+	query = q.bind(query, conn.driver)
+	if q.readOnly {
+		if err := checkReadOnly(query, q.AllowProcedures); err != nil {
+			return err
+		}
+		for i, stmt := range q.PreSQL {
+			if err := checkPreSQL(stmt, q.AllowProcedures); err != nil {
+				return fmt.Errorf("pre_sql %d: %v", i, err)
+			}
+		}
+		ctx = readOnlyContext(ctx, conn.driver)
+	}
+	// take a dedicated connection from the pool, this dials the server if
+	// there is no idle connection left
 	start := time.Now()
-	rows, err := conn.conn.Queryx(q.Query)
+	c, err := conn.conn.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	q.observe(conn, "connect", start)
+
+	var queryer sqlx.QueryerContext = c
+	var execer sqlx.ExecerContext = c
+	inTx := false
+	if q.readOnly {
+		tx, err := beginReadOnly(ctx, c, conn.driver)
+		if err != nil {
+			return err
+		}
+		if tx != nil {
+			// nothing is ever committed
+			defer tx.Rollback()
+			queryer, execer = tx, tx
+			inTx = true
+		}
+	}
+
+	// execute query, after the statements preparing the session
+	start = time.Now()
+	for i, stmt := range q.PreSQL {
+		if setsLocal(stmt) && (!inTx || dialect(conn.driver) != "postgres") {
+			// the setting would stay on the pooled connection
+			return fmt.Errorf("pre_sql %d: SET LOCAL only applies to the read-only transactions of postgres", i)
+		}
+		if _, err := execer.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("pre_sql %d: %v", i, err)
+		}
+	}
+	rows, err := queryer.QueryxContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
-	queryDuration := time.Since(start)
-	q.Durations.Observe(float64(queryDuration))
 	defer rows.Close()
+	q.observe(conn, "execute", start)
 
+	start = time.Now()
 	updated := 0
 	metrics := make([]prometheus.Metric, 0, len(q.metrics))
-	for rows.Next() {
-		res := make(map[string]interface{})
-		err := rows.MapScan(res)
+	var results []map[string]interface{} // rows of incremental queries
+	for set := 0; ; set++ {
+		arrays, err := arrayColumns(rows, conn.driver)
 		if err != nil {
-			level.Error(q.Logger).Log("msg", "Failed to scan", "err", err, "host", conn.host, "db", conn.database)
-			continue
+			return err
+		}
+		for q.readsResultSet(set) && rows.Next() {
+			res := make(map[string]interface{})
+			err := rows.MapScan(res)
+			if err == nil {
+				err = decodeArrays(res, arrays)
+			}
+			if err != nil && q.Incremental != nil {
+				// the watermark would move past the row
+				return err
+			}
+			if err != nil {
+				level.Error(q.Logger).Log("msg", "Failed to scan", "err", err, "host", conn.host, "db", conn.database, "result_set", set)
+				continue
+			}
+			if q.Incremental != nil {
+				results = append(results, res)
+				continue
+			}
+			res, values := q.mapRow(set, res)
+			m, err := q.updateMetrics(conn, res, values)
+			if err != nil {
+				level.Error(q.Logger).Log("msg", "Failed to update metrics", "err", err, "host", conn.host, "db", conn.database, "result_set", set)
+				continue
+			}
+			metrics = append(metrics, m...)
+			updated++
 		}
-		m, err := q.updateMetrics(conn, res)
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		// the remaining result sets are discarded when the rows are closed
+		if set+1 >= len(q.ResultSets) || !rows.NextResultSet() {
+			break
+		}
+	}
+	if q.Incremental != nil {
+		// all rows are added to the totals or none, a row that cannot be
+		// parsed would otherwise be skipped for good
+		metrics, err = q.accumulate(conn, results)
 		if err != nil {
-			level.Error(q.Logger).Log("msg", "Failed to update metrics", "err", err, "host", conn.host, "db", conn.database)
-			continue
+			return err
 		}
-		metrics = append(metrics, m...)
-		updated++
 	}
+	q.observe(conn, "fetch", start)
 
 	// update the metrics cache
 	q.Lock()
-	q.metrics[conn] = metrics
+	if !conn.isRetired() {
+		q.metrics[conn] = metrics
+		if q.lastRun == nil {
+			q.lastRun = make(map[*connection]time.Time)
+		}
+		q.lastRun[conn] = run
+	}
 	q.Unlock()
 
 	return nil
 }
 
+// forget drops the cached metrics of the connection
+func (q *Query) forget(conn *connection) {
+	q.Lock()
+	delete(q.metrics, conn)
+	delete(q.lastRun, conn)
+	q.Unlock()
+}
+
+// fresh reports whether the cached result of conn is younger than
+// min_interval. A tenth of the job interval is allowed for the jitter of the
+// job runs, so that the query isn't skipped once more than necessary.
+func (q *Query) fresh(conn *connection, now time.Time) bool {
+	if q.MinInterval <= 0 {
+		return false
+	}
+	q.Lock()
+	last, ok := q.lastRun[conn]
+	q.Unlock()
+	return ok && now.Sub(last)+q.interval/10 < q.MinInterval
+}
+
+// queryFor returns the SQL text for the driver and server version of conn
+func (q *Query) queryFor(conn *connection) (string, error) {
+	version := conn.serverVersion()
+	for _, v := range q.Variants {
+		if v.Driver != "" && !conn.matchesDriver(v.Driver) {
+			continue
+		}
+		if version.within(v.MinVersion, v.MaxVersion) {
+			return v.Query, nil
+		}
+	}
+	if q.Query == "" {
+		return "", fmt.Errorf("no query variant for driver %q version %q", conn.driver, version)
+	}
+	return q.Query, nil
+}
+
+// staticLabels are appended to the label columns of every query metric
+var staticLabels = []string{"driver", "host", "database", "user", "col"}
+
+// connLabelNames returns the static labels that describe the connection,
+// i.e. all but "col"
+func connLabelNames() []string {
+	names := make([]string, 0, len(staticLabels))
+	for _, name := range staticLabels {
+		if name != "col" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// metricName returns the metric name of the query, stripped of any
+// characters prometheus does not allow
+func (q *Query) metricName() string {
+	return MetricNameRE.ReplaceAllString("sql_"+q.Name, "")
+}
+
+// labelNames returns the variable label names of the query metric in the
+// order the label values are supplied to NewConstMetric
+func (q *Query) labelNames() []string {
+	names := make([]string, 0, len(q.Labels)+len(q.targetLabels)+len(staticLabels))
+	names = append(names, q.Labels...)
+	names = append(names, q.targetLabels...)
+	return append(names, staticLabels...)
+}
+
+// metric types of queries
+const (
+	typeGauge   = "gauge"
+	typeCounter = "counter"
+	typeUntyped = "untyped"
+)
+
+// valueType returns the prometheus type of the query metric, incremental
+// queries expose running totals
+func (q *Query) valueType() prometheus.ValueType {
+	switch {
+	case q.Incremental != nil || q.Type == typeCounter:
+		return prometheus.CounterValue
+	case q.Type == typeUntyped:
+		return prometheus.UntypedValue
+	}
+	return prometheus.GaugeValue
+}
+
+// observe records the time elapsed since start for the given query phase
+func (q *Query) observe(conn *connection, phase string, start time.Time) {
+	if q.durations == nil {
+		return
+	}
+	q.durations.WithLabelValues(conn.host, conn.database, phase).Observe(time.Since(start).Seconds())
+}
+
 // updateMetrics parses the result set and returns a slice of const metrics
-func (q *Query) updateMetrics(conn *connection, res map[string]interface{}) ([]prometheus.Metric, error) {
+// of the given values
+func (q *Query) updateMetrics(conn *connection, res map[string]interface{}, values []string) ([]prometheus.Metric, error) {
 	updated := 0
-	metrics := make([]prometheus.Metric, 0, len(q.Values))
-	for _, valueName := range q.Values {
+	metrics := make([]prometheus.Metric, 0, len(values))
+	for _, valueName := range values {
 		m, err := q.updateMetric(conn, res, valueName)
 		if err != nil {
 			level.Error(q.Logger).Log(
@@ -97,17 +290,38 @@ func (q *Query) updateMetrics(conn *connection, res map[string]interface{}) ([]p
 
 // updateMetrics parses a single row and returns a const metric
 func (q *Query) updateMetric(conn *connection, res map[string]interface{}, valueName string) (prometheus.Metric, error) {
+	value, err := q.value(res, valueName)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := q.rowLabels(res)
+	if err != nil {
+		return nil, err
+	}
+	return q.newMetric(conn, value, labels, valueName)
+}
+
+// value parses the value column of a single row
+func (q *Query) value(res map[string]interface{}, valueName string) (float64, error) {
 	var value float64
 	if i, ok := res[valueName]; ok {
 		switch f := i.(type) {
 		case int:
 			value = float64(f)
+		case int8:
+			value = float64(f)
+		case int16:
+			value = float64(f)
 		case int32:
 			value = float64(f)
 		case int64:
 			value = float64(f)
 		case uint:
 			value = float64(f)
+		case uint8:
+			value = float64(f)
+		case uint16:
+			value = float64(f)
 		case uint32:
 			value = float64(f)
 		case uint64:
@@ -116,25 +330,47 @@ func (q *Query) updateMetric(conn *connection, res map[string]interface{}, value
 			value = float64(f)
 		case float64:
 			value = float64(f)
+		case bool:
+			if f {
+				value = 1
+			}
+		case time.Time:
+			// timestamps are exposed as unix time like time() in PromQL
+			value = float64(f.UnixNano()) / 1e9
+		case time.Duration:
+			value = f.Seconds()
 		case []uint8:
-			val, err := strconv.ParseFloat(string(f), 64)
+			val, err := parseNumber(string(f))
 			if err != nil {
-				return nil, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
+				return 0, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
 			}
 			value = val
 		case string:
-			val, err := strconv.ParseFloat(f, 64)
+			// numeric and interval columns of pgx arrive in their text form
+			val, err := parseNumber(f)
 			if err != nil {
-				return nil, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
+				return 0, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
 			}
 			value = val
+		case []interface{}:
+			// decoded pgx arrays
+			return 0, fmt.Errorf("Column '%s' is an array, arrays can only be labels", valueName)
 		default:
-			return nil, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
+			// e.g. the pointers of nullable ClickHouse columns
+			val, err := reflectFloat(i)
+			if err != nil {
+				return 0, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %v)", valueName, i, f)
+			}
+			value = val
 		}
 	}
-	// make space for all defined variable label columns and the "static" labels
-	// added below
-	labels := make([]string, 0, len(q.Labels)+5)
+	return value, nil
+}
+
+// rowLabels parses the label columns of a single row
+func (q *Query) rowLabels(res map[string]interface{}) ([]string, error) {
+	// make space for all defined variable label columns
+	labels := make([]string, 0, len(q.Labels))
 	for _, label := range q.Labels {
 		// we need to fill every spot in the slice or the key->value mapping
 		// won't match up in the end.
@@ -147,12 +383,41 @@ func (q *Query) updateMetric(conn *connection, res map[string]interface{}, value
 				lv = str
 			case []uint8:
 				lv = string(str)
+			case int64:
+				lv = strconv.FormatInt(str, 10)
+			case float64:
+				lv = strconv.FormatFloat(str, 'g', -1, 64)
+			case bool:
+				lv = strconv.FormatBool(str)
+			case time.Time:
+				lv = str.Format(time.RFC3339Nano)
+			case []interface{}:
+				// decoded pgx arrays
+				lv = joinArray(str)
+			case nil:
+				// NULL
 			default:
-				return nil, fmt.Errorf("Column '%s' must be type text (string)", label)
+				s, err := reflectString(i)
+				if err != nil {
+					return nil, fmt.Errorf("Column '%s' must be type text (string)", label)
+				}
+				lv = s
 			}
 		}
 		labels = append(labels, lv)
 	}
+	return labels, nil
+}
+
+// newMetric returns the const metric of a value with the values of the label
+// columns
+func (q *Query) newMetric(conn *connection, value float64, labels []string, valueName string) (prometheus.Metric, error) {
+	// make space for the "static" labels added below, the labels of
+	// incremental queries are kept in their totals and must not change
+	labels = append(make([]string, 0, len(labels)+len(q.targetLabels)+len(staticLabels)), labels...)
+	// connections without the label, e.g. those not read from target files,
+	// get an empty value
+	labels = append(labels, conn.targetLabels(q.targetLabels)...)
 	labels = append(labels, conn.driver)
 	labels = append(labels, conn.host)
 	labels = append(labels, conn.database)
@@ -161,5 +426,144 @@ func (q *Query) updateMetric(conn *connection, res map[string]interface{}, value
 	// create a new immutable const metric that can be cached and returned on
 	// every scrape. Remember that the order of the lable values in the labels
 	// slice must match the order of the label names in the descriptor!
-	return prometheus.NewConstMetric(q.desc, prometheus.GaugeValue, value, labels...)
+	return prometheus.NewConstMetric(q.desc, q.valueType(), value, labels...)
+}
+
+// reflectFloat converts the values of other numeric types, pointers to them
+// and types like decimals with a Float64 method
+func reflectFloat(i interface{}) (float64, error) {
+	if d, ok := i.(interface{ Float64() (float64, bool) }); ok {
+		f, _ := d.Float64()
+		return f, nil
+	}
+	v := reflect.ValueOf(i)
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return 0, fmt.Errorf("value is NULL")
+		}
+		return reflectFloat(v.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	case reflect.String:
+		return parseNumber(v.String())
+	}
+	if t, ok := i.(time.Time); ok {
+		return float64(t.UnixNano()) / 1e9, nil
+	}
+	return 0, fmt.Errorf("unsupported type %T", i)
+}
+
+// reflectString converts the values of other types, pointers to them and
+// types like IP addresses with a String method to a label value
+func reflectString(i interface{}) (string, error) {
+	v := reflect.ValueOf(i)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		return reflectString(v.Elem().Interface())
+	}
+	switch s := i.(type) {
+	case string:
+		return s, nil
+	case []byte:
+		return string(s), nil
+	case time.Time:
+		return s.Format(time.RFC3339Nano), nil
+	case fmt.Stringer:
+		return s.String(), nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+		return fmt.Sprint(i), nil
+	}
+	return "", fmt.Errorf("unsupported type %T", i)
+}
+
+// parseNumber parses a number or a PostgreSQL interval like
+// "1 day 02:03:04.5" as seconds
+func parseNumber(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+		return f, nil
+	}
+	return parseInterval(s)
+}
+
+// intervalUnits are the seconds of the units of a PostgreSQL interval,
+// years and months count like in EXTRACT(EPOCH FROM interval)
+var intervalUnits = map[string]float64{
+	"year":  365.25 * 86400,
+	"years": 365.25 * 86400,
+	"mon":   30 * 86400,
+	"mons":  30 * 86400,
+	"day":   86400,
+	"days":  86400,
+}
+
+// parseInterval parses an interval in the default "postgres" IntervalStyle,
+// e.g. "1 year 2 mons 3 days -04:05:06.789"
+func parseInterval(s string) (float64, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid interval %q", s)
+	}
+	var seconds float64
+	for i := 0; i < len(fields); i++ {
+		if strings.Contains(fields[i], ":") {
+			t, err := parseClock(fields[i])
+			if err != nil {
+				return 0, fmt.Errorf("invalid interval %q", s)
+			}
+			seconds += t
+			continue
+		}
+		n, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil || i+1 >= len(fields) {
+			return 0, fmt.Errorf("invalid interval %q", s)
+		}
+		unit, ok := intervalUnits[fields[i+1]]
+		if !ok {
+			return 0, fmt.Errorf("invalid interval %q", s)
+		}
+		seconds += n * unit
+		i++
+	}
+	return seconds, nil
+}
+
+// parseClock parses the time part of an interval, e.g. -04:05:06.789
+func parseClock(s string) (float64, error) {
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign, s = -1, s[1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	sec, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, err
+	}
+	return sign * (h*3600 + m*60 + sec), nil
 }
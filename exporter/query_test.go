@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPreSQL(t *testing.T) {
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  read_only: false
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - name: q
+    help: h
+    values: [v]
+    pre_sql:
+    - CREATE TEMP TABLE IF NOT EXISTS t (v INTEGER)
+    - DELETE FROM t
+    - INSERT INTO t VALUES (5)
+    query: SELECT v FROM t
+`)
+	if err := exp.jobs[0].runOnce(0); err != nil {
+		t.Fatal(err)
+	}
+	gatherAndCompare(t, exp, dir, `
+# HELP sql_q h
+# TYPE sql_q gauge
+sql_q{col="v",database="DIR/x.db",driver="sqlite",host="DIR/x.db",sql_job="a",user=""} 5
+`, "sql_q")
+
+	// e.g. a sqlite target of connections_from, which validation doesn't see
+	exp = newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@host/db']
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v, pre_sql: ["SET LOCAL cache_size = 10"]}
+`)
+	j := exp.jobs[0]
+	u, err := url.Parse("sqlite://" + dir + "/x.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newConnection(u)
+	if err := conn.connect(j); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.close()
+	err = j.Queries[0].Run(ContextWithTracer(context.Background(), *j.tracer), conn)
+	if err == nil || !strings.Contains(err.Error(), "SET LOCAL only applies to the read-only transactions of postgres") {
+		t.Fatalf("got error %v, want SET LOCAL to be refused", err)
+	}
+}
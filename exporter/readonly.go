@@ -0,0 +1,460 @@
+package exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/jmoiron/sqlx"
+)
+
+// writeKeywords start statements that change data, schema, permissions or
+// settings, or run code that may do so. Statements starting with one of them
+// are rejected in read-only mode.
+var writeKeywords = map[string]bool{
+	"insert":     true,
+	"update":     true,
+	"delete":     true,
+	"merge":      true,
+	"upsert":     true,
+	"replace":    true,
+	"create":     true,
+	"alter":      true,
+	"drop":       true,
+	"undrop":     true,
+	"truncate":   true,
+	"rename":     true,
+	"exchange":   true,
+	"comment":    true,
+	"grant":      true,
+	"revoke":     true,
+	"reassign":   true,
+	"copy":       true,
+	"load":       true,
+	"import":     true,
+	"attach":     true,
+	"detach":     true,
+	"vacuum":     true,
+	"reindex":    true,
+	"cluster":    true,
+	"refresh":    true,
+	"optimize":   true,
+	"checkpoint": true,
+	"backup":     true,
+	"restore":    true,
+	"dbcc":       true,
+	"lock":       true,
+	"kill":       true,
+	"shutdown":   true,
+	"system":     true,
+	"notify":     true,
+	"set":        true,
+	"pragma":     true,
+	"do":         true,
+	"call":       true,
+	"exec":       true,
+	"execute":    true,
+}
+
+// writeFunctions change the state of the server, although they are called
+// by queries that only read, e.g. SELECT pg_terminate_backend(pid)
+var writeFunctions = map[string]bool{
+	"pg_terminate_backend":                true,
+	"pg_cancel_backend":                   true,
+	"pg_reload_conf":                      true,
+	"pg_rotate_logfile":                   true,
+	"pg_switch_wal":                       true,
+	"pg_switch_xlog":                      true,
+	"pg_promote":                          true,
+	"pg_create_restore_point":             true,
+	"pg_start_backup":                     true,
+	"pg_stop_backup":                      true,
+	"pg_backup_start":                     true,
+	"pg_backup_stop":                      true,
+	"pg_create_physical_replication_slot": true,
+	"pg_create_logical_replication_slot":  true,
+	"pg_drop_replication_slot":            true,
+	"pg_replication_slot_advance":         true,
+	"pg_logical_slot_get_changes":         true,
+	"pg_stat_reset":                       true,
+	"pg_stat_reset_shared":                true,
+	"pg_stat_statements_reset":            true,
+	"pg_file_write":                       true,
+	"pg_file_rename":                      true,
+	"pg_file_unlink":                      true,
+	"setval":                              true,
+	"nextval":                             true,
+	"lo_create":                           true,
+	"lo_creat":                            true,
+	"lo_import":                           true,
+	"lo_export":                           true,
+	"lo_unlink":                           true,
+	"lo_put":                              true,
+	"lo_from_bytea":                       true,
+	"dblink":                              true,
+	"dblink_exec":                         true,
+	"dblink_open":                         true,
+	"dblink_send_query":                   true,
+}
+
+// statementPrefixes precede the keyword of a statement, e.g. EXPLAIN ANALYZE
+// DELETE runs the DELETE
+var statementPrefixes = map[string]bool{
+	"explain": true,
+	"analyze": true,
+	"analyse": true,
+	"verbose": true,
+	"begin":   true,
+}
+
+// batchKeywords may start the first statement of a query. SQL Server calls
+// the procedure named by any other word there without EXEC, e.g.
+// xp_cmdshell 'dir'.
+var batchKeywords = map[string]bool{
+	"select":   true,
+	"with":     true,
+	"values":   true,
+	"table":    true,
+	"show":     true,
+	"describe": true,
+	"desc":     true,
+	"exists":   true,
+	"declare":  true,
+	"if":       true,
+	"while":    true,
+	"print":    true,
+	"use":      true,
+}
+
+// procedureKeywords call the stored procedure named after them, which is
+// allowed if the query lists it in allow_procedures
+var procedureKeywords = map[string]bool{
+	"exec":    true,
+	"execute": true,
+	"call":    true,
+}
+
+// readOnly reports whether the queries of the job run read-only
+func (j *Job) readOnly() bool {
+	return j.ReadOnly == nil || *j.ReadOnly
+}
+
+// checkReadOnly reports the first statement of the query that writes, or the
+// first call of a function that does. Only the keywords leading a statement
+// count, so that e.g. a column named load may be selected, except INTO, which
+// makes a SELECT write a table, a file or variables. The procedures may be
+// called although they may write.
+func checkReadOnly(query string, procedures []string) error {
+	return scanWrites(query, nil, procedures)
+}
+
+// checkPreSQL is checkReadOnly for the statements run before a query, which
+// may change the settings of the session with SET
+func checkPreSQL(stmt string, procedures []string) error {
+	return scanWrites(stmt, map[string]bool{"set": true}, procedures)
+}
+
+// setsLocal reports whether the pre_sql statement is a SET LOCAL, which only
+// lasts until the end of the transaction. Only postgres has it, MySQL takes
+// it for SET SESSION.
+func setsLocal(stmt string) bool {
+	words := strings.Fields(strings.ToLower(stmt))
+	return len(words) >= 2 && words[0] == "set" && words[1] == "local"
+}
+
+// scanFrame is the state of scanWrites in a level of parentheses
+type scanFrame struct {
+	with    bool // in a WITH statement, before its main statement
+	options bool // the options of a statement prefix, e.g. EXPLAIN (ANALYZE)
+}
+
+// scanWrites reports the first write of the query that isn't allowed
+func scanWrites(query string, allowed map[string]bool, procedures []string) error {
+	if err := checkBatchStart(query, allowed, procedures); err != nil {
+		return err
+	}
+	frames := []scanFrame{{}}
+	lead := true    // the next word leads a statement
+	prefix := false // the previous word is a statement prefix
+	prev := ""      // the previous word, empty after other tokens
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			i++
+			continue
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			i = skipPast(query, i+2, "\n")
+			continue
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			i = skipPast(query, i+2, "*/")
+			continue
+		case ch == '\'' || ch == '"' || ch == '`':
+			i = skipQuoted(query, i+1, ch)
+		case ch == '[':
+			// SQL Server identifier
+			i = skipPast(query, i+1, "]")
+		case ch == '$':
+			// PostgreSQL dollar quoting, $$...$$ or $tag$...$tag$
+			end := strings.IndexByte(query[i+1:], '$')
+			if end < 0 || !isIdent(query[i+1:i+1+end]) {
+				i++
+				break
+			}
+			tag := query[i : i+end+2]
+			i = skipPast(query, i+len(tag), tag)
+		case isIdentStart(ch):
+			start := i
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+			word := strings.ToLower(query[start:i])
+			if next := strings.TrimLeft(query[i:], " \t\r\n"); strings.HasPrefix(next, "(") && writeFunctions[word] {
+				return fmt.Errorf("%s() is not allowed in read-only mode", word)
+			}
+			if word == "into" {
+				// SELECT INTO, INTO OUTFILE, INTO @var and the like
+				return fmt.Errorf("INTO is not allowed in read-only mode")
+			}
+			leads := lead
+			lead, prefix, prev = false, false, word
+			if !leads {
+				continue
+			}
+			top := &frames[len(frames)-1]
+			switch {
+			case procedureKeywords[word] && !allowed[word]:
+				name, end := procedureName(query, i)
+				if name == "" {
+					return fmt.Errorf("%s is not allowed in read-only mode", strings.ToUpper(word))
+				}
+				if !allowsProcedure(procedures, name) {
+					return fmt.Errorf("%s %s is not allowed in read-only mode", strings.ToUpper(word), name)
+				}
+				// the arguments follow
+				i = end
+			case writeKeywords[word] && !allowed[word]:
+				return fmt.Errorf("%s is not allowed in read-only mode", strings.ToUpper(word))
+			case statementPrefixes[word]:
+				lead, prefix = true, true
+			case word == "with":
+				top.with = true
+			case top.with && word != "as":
+				// the main statement follows the queries of the WITH
+				top.with = false
+			}
+			continue
+		case ch == '(':
+			// subqueries and the queries of a WITH lead statements, the
+			// arguments of functions don't
+			lead = !prefix && (prev == "" || prev == "as" || prev == "materialized")
+			frames = append(frames, scanFrame{options: prefix})
+			prefix, prev = false, ""
+			i++
+			continue
+		case ch == ')':
+			lead = false
+			if len(frames) > 1 {
+				closed := frames[len(frames)-1]
+				frames = frames[:len(frames)-1]
+				lead = closed.options || frames[len(frames)-1].with
+			}
+			prefix, prev = false, ""
+			i++
+			continue
+		case ch == ';':
+			frames = []scanFrame{{}}
+			lead, prefix, prev = true, false, ""
+			i++
+			continue
+		default:
+			i++
+		}
+		// literals, operators and the like
+		lead, prefix, prev = false, false, ""
+	}
+	return nil
+}
+
+// checkBatchStart reports a procedure called by the first word of the query
+func checkBatchStart(query string, allowed map[string]bool, procedures []string) error {
+	i := skipSpace(query, 0)
+	if i == len(query) || query[i] == '(' || query[i] == ';' {
+		return nil
+	}
+	end := i
+	for end < len(query) && isIdentChar(query[end]) {
+		end++
+	}
+	word := strings.ToLower(query[i:end])
+	if batchKeywords[word] || statementPrefixes[word] || allowed[word] || writeKeywords[word] {
+		// writes are reported by scanWrites
+		return nil
+	}
+	if name, _ := procedureName(query, i); name != "" && allowsProcedure(procedures, name) {
+		return nil
+	}
+	if end == i {
+		// a quoted name, e.g. [dbo].[p]
+		end = strings.IndexAny(query[i:], " \t\r\n")
+		if end < 0 {
+			end = len(query) - i
+		}
+		end += i
+	}
+	return fmt.Errorf("%s calls a procedure, which is not allowed in read-only mode", query[i:end])
+}
+
+// procedureName returns the name of the procedure called at i, lower case
+// and without quotes, e.g. dbo.p for [dbo].[P], and the index after it. The
+// variable taking the return value, EXEC @rc = p, is skipped. The name is
+// empty if there is none, e.g. for EXEC ('...').
+func procedureName(query string, i int) (string, int) {
+	i = skipSpace(query, i)
+	if i < len(query) && query[i] == '@' {
+		end := i + 1
+		for end < len(query) && isIdentChar(query[end]) {
+			end++
+		}
+		end = skipSpace(query, end)
+		if end >= len(query) || query[end] != '=' {
+			return "", i
+		}
+		i = skipSpace(query, end+1)
+	}
+	var parts []string
+	for i < len(query) {
+		switch ch := query[i]; {
+		case ch == '[' || ch == '"' || ch == '`':
+			closing := ch
+			if ch == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(query[i+1:], closing)
+			if end < 0 {
+				return "", i
+			}
+			parts = append(parts, query[i+1:i+1+end])
+			i += end + 2
+		case isIdentStart(ch):
+			start := i
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+			parts = append(parts, query[start:i])
+		default:
+			return "", i
+		}
+		if i >= len(query) || query[i] != '.' {
+			break
+		}
+		i++
+	}
+	if len(parts) == 0 {
+		return "", i
+	}
+	return strings.ToLower(strings.Join(parts, ".")), i
+}
+
+// allowsProcedure reports whether the procedure is one of procedures, which
+// are compared like procedureName returns them
+func allowsProcedure(procedures []string, name string) bool {
+	for _, p := range procedures {
+		if allowed, _ := procedureName(p, 0); allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// skipSpace returns the index of the next token after whitespace and comments
+func skipSpace(query string, i int) int {
+	for i < len(query) {
+		switch ch := query[i]; {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			i = skipPast(query, i+2, "\n")
+		case strings.HasPrefix(query[i:], "/*"):
+			i = skipPast(query, i+2, "*/")
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipPast returns the index after the next end, or the end of the query
+func skipPast(query string, i int, end string) int {
+	n := strings.Index(query[i:], end)
+	if n < 0 {
+		return len(query)
+	}
+	return i + n + len(end)
+}
+
+// skipQuoted returns the index after the closing quote, quotes inside are
+// doubled
+func skipQuoted(query string, i int, quote byte) int {
+	for i < len(query) {
+		if query[i] == quote {
+			if i+1 < len(query) && query[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return i
+}
+
+func isIdentStart(ch byte) bool {
+	return ch == '_' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z'
+}
+
+func isIdentChar(ch byte) bool {
+	return isIdentStart(ch) || '0' <= ch && ch <= '9' || ch == '$'
+}
+
+func isIdent(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isIdentChar(s[i]) || s[i] == '$' {
+			return false
+		}
+	}
+	return true
+}
+
+// beginReadOnly starts the transaction a query runs in, which is rolled back
+// afterwards. It returns nil for drivers without transactions.
+func beginReadOnly(ctx context.Context, c *sqlx.Conn, driver string) (*sqlx.Tx, error) {
+	switch dialect(driver) {
+	case "postgres", "mysql":
+		// BEGIN READ ONLY and START TRANSACTION READ ONLY
+		return c.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	case "sqlite":
+		// the driver ignores the read-only option
+		if _, err := c.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+			return nil, err
+		}
+		return c.BeginTxx(ctx, nil)
+	case "sqlserver", "mssql":
+		// there are no read-only transactions, changes are rolled back
+		return c.BeginTxx(ctx, nil)
+	}
+	// ClickHouse has no transactions, see readOnlyContext
+	return nil, nil
+}
+
+// readOnlyContext returns the context of a query in read-only mode. The
+// queries of ClickHouse, which has no read-only transactions, are run with
+// its readonly setting.
+func readOnlyContext(ctx context.Context, driver string) context.Context {
+	if dialect(driver) != "clickhouse" {
+		return ctx
+	}
+	return clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{"readonly": 1}))
+}
@@ -0,0 +1,123 @@
+package exporter
+
+import (
+	"testing"
+)
+
+func TestCheckReadOnly(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		err   string // empty if the query is read-only
+	}{
+		{"SELECT 1", ""},
+		{"SELECT 1 AS lock", ""},
+		{"SELECT load FROM t", ""},
+		{"SELECT do FROM t", ""},
+		{"SELECT replace(name, 'a', 'b'), t.update FROM t", ""},
+		{"SELECT 'DELETE FROM t' AS q -- DROP TABLE t", ""},
+		{"SELECT $$DELETE$$, $x$DROP$x$ /* DROP */", ""},
+		{"SELECT [delete] FROM t", ""},
+		{"SELECT * FROM t WHERE id IN (SELECT id FROM u) ORDER BY load", ""},
+		{"WITH x AS (SELECT 1 AS set) SELECT set FROM x", ""},
+		{"WITH x(a) AS (SELECT 1), y AS NOT MATERIALIZED (SELECT 2) SELECT * FROM x, y", ""},
+		{"EXPLAIN ANALYZE SELECT 1", ""},
+		{"SELECT pg_is_in_recovery(), now()", ""},
+		{"SELECT 1; SELECT 2;", ""},
+		{"SHOW STATUS", ""},
+		{"DECLARE @n int = 1; SELECT @n", ""},
+		{"SELECT 1 AS \"into\"", ""},
+		{";WITH x AS (SELECT 1 AS a) SELECT a FROM x", ""},
+
+		{"DELETE FROM t", "DELETE is not allowed in read-only mode"},
+		{"  -- comment\n/* comment */ insert INTO t VALUES (1)", "INSERT is not allowed in read-only mode"},
+		{"SELECT 1; DROP TABLE t", "DROP is not allowed in read-only mode"},
+		{"(DELETE FROM t)", "DELETE is not allowed in read-only mode"},
+		{"WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", "DELETE is not allowed in read-only mode"},
+		{"WITH RECURSIVE x AS (SELECT 1) DELETE FROM t", "DELETE is not allowed in read-only mode"},
+		{"WITH x AS MATERIALIZED (UPDATE t SET a = 1 RETURNING a) SELECT a FROM x", "UPDATE is not allowed in read-only mode"},
+		{"EXPLAIN ANALYZE DELETE FROM t", "DELETE is not allowed in read-only mode"},
+		{"EXPLAIN (ANALYZE, BUFFERS) UPDATE t SET a = 1", "UPDATE is not allowed in read-only mode"},
+		{"BEGIN DELETE FROM t END", "DELETE is not allowed in read-only mode"},
+		{"SELECT pg_terminate_backend(1)", "pg_terminate_backend() is not allowed in read-only mode"},
+		{"SELECT pg_catalog.setval('s', 1)", "setval() is not allowed in read-only mode"},
+		{"SELECT count(*) FROM t WHERE nextval ('s') > 0", "nextval() is not allowed in read-only mode"},
+		{"CALL p()", "CALL p is not allowed in read-only mode"},
+		{"EXEC xp_cmdshell 'dir'", "EXEC xp_cmdshell is not allowed in read-only mode"},
+		{"EXECUTE stmt", "EXECUTE stmt is not allowed in read-only mode"},
+		{"SYSTEM STOP MERGES", "SYSTEM is not allowed in read-only mode"},
+		{"SET search_path = x", "SET is not allowed in read-only mode"},
+		{"DO $$ BEGIN END $$", "DO is not allowed in read-only mode"},
+		{"LOCK TABLE t", "LOCK is not allowed in read-only mode"},
+		{"SELECT * FROM t INTO OUTFILE '/tmp/t'", "INTO is not allowed in read-only mode"},
+		{"SELECT a INTO DUMPFILE '/tmp/a' FROM t", "INTO is not allowed in read-only mode"},
+		{"SELECT count(*) INTO @n FROM t", "INTO is not allowed in read-only mode"},
+		{"SELECT * INTO t2 FROM t", "INTO is not allowed in read-only mode"},
+		{"SELECT * FROM dblink('db', 'DELETE FROM t RETURNING 1') AS d(a int)", "dblink() is not allowed in read-only mode"},
+		{"SELECT dblink_send_query('c', 'DELETE FROM t')", "dblink_send_query() is not allowed in read-only mode"},
+		{"xp_cmdshell 'dir'", "xp_cmdshell calls a procedure, which is not allowed in read-only mode"},
+		{"/* config */ sp_configure 'xp_cmdshell', 1", "sp_configure calls a procedure, which is not allowed in read-only mode"},
+		{"[dbo].[p] 1", "[dbo].[p] calls a procedure, which is not allowed in read-only mode"},
+	} {
+		err := checkReadOnly(tc.query, nil)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: %v", tc.query, err)
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("%q: got error %v, want %s", tc.query, err, tc.err)
+		}
+	}
+}
+
+func TestCheckPreSQL(t *testing.T) {
+	for _, tc := range []struct {
+		stmt string
+		err  string
+	}{
+		{"SET statement_timeout = '5s'", ""},
+		{"SET LOCAL work_mem = '64MB'", ""},
+		{"EXEC sp_set_session_context 'k', 'v'", "EXEC sp_set_session_context is not allowed in read-only mode"},
+		{"SET x = 1; DELETE FROM t", "DELETE is not allowed in read-only mode"},
+		{"sp_set_session_context 'k', 'v'", "sp_set_session_context calls a procedure, which is not allowed in read-only mode"},
+	} {
+		err := checkPreSQL(tc.stmt, nil)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: %v", tc.stmt, err)
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("%q: got error %v, want %s", tc.stmt, err, tc.err)
+		}
+	}
+}
+
+func TestAllowProcedures(t *testing.T) {
+	procedures := []string{"dbo.collect_diagnostics", "[dbo].[Stats]", "p"}
+	for _, tc := range []struct {
+		query string
+		err   string
+	}{
+		{"EXEC dbo.collect_diagnostics", ""},
+		{"exec [dbo].[collect_diagnostics] @days = 1", ""},
+		{"EXECUTE @rc = dbo.stats 'x'", ""},
+		{"dbo.collect_diagnostics", ""},
+		{"SELECT 1; EXEC dbo.collect_diagnostics; SELECT 2", ""},
+		{"CALL p(1, 'a')", ""},
+
+		{"EXEC collect_diagnostics", "EXEC collect_diagnostics is not allowed in read-only mode"},
+		{"EXEC dbo.collect_diagnostics; DELETE FROM t", "DELETE is not allowed in read-only mode"},
+		{"EXEC ('EXEC dbo.collect_diagnostics')", "EXEC is not allowed in read-only mode"},
+		{"EXEC @p", "EXEC is not allowed in read-only mode"},
+		{"CALL q()", "CALL q is not allowed in read-only mode"},
+		{"dbo.other", "dbo calls a procedure, which is not allowed in read-only mode"},
+	} {
+		err := checkReadOnly(tc.query, procedures)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: %v", tc.query, err)
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("%q: got error %v, want %s", tc.query, err, tc.err)
+		}
+	}
+	if err := checkPreSQL("EXEC sp_set_session_context 'k', 'v'", []string{"sp_set_session_context"}); err != nil {
+		t.Error(err)
+	}
+}
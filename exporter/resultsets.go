@@ -0,0 +1,73 @@
+package exporter
+
+// ResultSet maps the columns of a result set to the labels and values of the
+// query, e.g. of a stored procedure returning several result sets. Labels and
+// values without a mapping are read from the column of the same name, values
+// missing from the result set are skipped.
+type ResultSet struct {
+	Skip   bool              `yaml:"skip,omitempty"`   // ignore the result set
+	Labels map[string]string `yaml:"labels,omitempty"` // label of the query to column of the result set
+	Values map[string]string `yaml:"values,omitempty"` // value of the query to column of the result set
+}
+
+// clone returns a copy of the result set that shares no maps with it
+func (rs *ResultSet) clone() *ResultSet {
+	if rs == nil {
+		return nil
+	}
+	c := &ResultSet{
+		Skip:   rs.Skip,
+		Labels: make(map[string]string, len(rs.Labels)),
+		Values: make(map[string]string, len(rs.Values)),
+	}
+	for k, v := range rs.Labels {
+		c.Labels[k] = v
+	}
+	for k, v := range rs.Values {
+		c.Values[k] = v
+	}
+	return c
+}
+
+// readsResultSet reports whether the result set at index i is read. Only the
+// first one is read, unless result_sets are configured.
+func (q *Query) readsResultSet(i int) bool {
+	if len(q.ResultSets) == 0 {
+		return i == 0
+	}
+	return i < len(q.ResultSets) && (q.ResultSets[i] == nil || !q.ResultSets[i].Skip)
+}
+
+// mapRow maps a row of the result set at index i to the label and value
+// columns of the query. It returns the names of the values the row has.
+func (q *Query) mapRow(i int, res map[string]interface{}) (map[string]interface{}, []string) {
+	if len(q.ResultSets) == 0 {
+		return res, q.Values
+	}
+	rs := q.ResultSets[i]
+	if rs == nil {
+		rs = &ResultSet{}
+	}
+	mapped := make(map[string]interface{}, len(q.Labels)+len(q.Values))
+	for _, label := range q.Labels {
+		column := label
+		if c, ok := rs.Labels[label]; ok {
+			column = c
+		}
+		if v, ok := res[column]; ok {
+			mapped[label] = v
+		}
+	}
+	values := make([]string, 0, len(q.Values))
+	for _, value := range q.Values {
+		column := value
+		if c, ok := rs.Values[value]; ok {
+			column = c
+		}
+		if v, ok := res[column]; ok {
+			mapped[value] = v
+			values = append(values, value)
+		}
+	}
+	return mapped, values
+}
@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// multiConnector connects to a database returning the result sets of
+// multiResults to every query, which sqlite can't do
+type multiConnector struct{}
+
+func (multiConnector) Connect(context.Context) (driver.Conn, error) { return multiConn{}, nil }
+func (multiConnector) Driver() driver.Driver                        { return nil }
+
+type multiConn struct{}
+
+func (multiConn) Prepare(string) (driver.Stmt, error) { return nil, io.EOF }
+func (multiConn) Close() error                        { return nil }
+func (multiConn) Begin() (driver.Tx, error)           { return nil, io.EOF }
+
+func (multiConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &multiRows{}, nil
+}
+
+// multiResults are the columns and the single row of each result set
+var multiResults = []struct {
+	columns []string
+	row     []driver.Value
+}{
+	{[]string{"name", "v"}, []driver.Value{"x", int64(1)}},
+	{[]string{"name", "v"}, []driver.Value{"y", int64(2)}},
+	{[]string{"other", "w", "v2"}, []driver.Value{"z", int64(3), int64(9)}},
+}
+
+type multiRows struct {
+	set  int
+	read bool
+}
+
+func (r *multiRows) Columns() []string { return multiResults[r.set].columns }
+func (r *multiRows) Close() error      { return nil }
+
+func (r *multiRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	copy(dest, multiResults[r.set].row)
+	r.read = true
+	return nil
+}
+
+func (r *multiRows) HasNextResultSet() bool { return r.set+1 < len(multiResults) }
+
+func (r *multiRows) NextResultSet() error {
+	if !r.HasNextResultSet() {
+		return io.EOF
+	}
+	r.set++
+	r.read = false
+	return nil
+}
+
+func TestResultSets(t *testing.T) {
+	dir := t.TempDir()
+	exp := newTestExporter(t, dir, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - name: first
+    help: h
+    labels: [name]
+    values: [v]
+    query: SELECT 1
+  - name: sets
+    help: h
+    labels: [name]
+    values: [v]
+    result_sets:
+    - {}
+    - {skip: true}
+    - labels: {name: other}
+      values: {v: w}
+    query: SELECT 1
+`)
+	j := exp.jobs[0]
+	conn := &connection{conn: sqlx.NewDb(sql.OpenDB(multiConnector{}), "multi"), driver: "multi", database: "multi"}
+	j.connsMu.Lock()
+	j.conns = []*connection{conn}
+	j.connsMu.Unlock()
+	ctx := ContextWithTracer(context.Background(), *j.tracer)
+	for _, q := range j.Queries {
+		if err := q.Run(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// without result_sets only the first one is read
+	gatherAndCompare(t, exp, dir, `
+# HELP sql_first h
+# TYPE sql_first gauge
+sql_first{col="v",database="multi",driver="multi",host="",name="x",sql_job="a",user=""} 1
+# HELP sql_sets h
+# TYPE sql_sets gauge
+sql_sets{col="v",database="multi",driver="multi",host="",name="x",sql_job="a",user=""} 1
+sql_sets{col="v",database="multi",driver="multi",host="",name="z",sql_job="a",user=""} 3
+`, "sql_first", "sql_sets")
+}
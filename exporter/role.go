@@ -0,0 +1,80 @@
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// roles of a server, a query with run_on any (or empty) runs on both
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+	roleAny     = "any"
+)
+
+// roleQueries return true on replicas for each driver
+var roleQueries = map[string]string{
+	"postgres": "SELECT pg_is_in_recovery()",
+	"mysql":    "SELECT @@global.read_only",
+	// servers without availability group are primaries
+	"sqlserver": "SELECT CASE WHEN EXISTS (SELECT 1 FROM sys.dm_hadr_availability_replica_states WHERE is_local = 1 AND role_desc = 'SECONDARY') THEN 1 ELSE 0 END",
+	"mssql":     "SELECT CASE WHEN EXISTS (SELECT 1 FROM sys.dm_hadr_availability_replica_states WHERE is_local = 1 AND role_desc = 'SECONDARY') THEN 1 ELSE 0 END",
+}
+
+// detectRole queries the role of the server. Unlike the version it is
+// detected on every run, as it changes with a failover. It returns the
+// previous role.
+func (c *connection) detectRole(conn *sqlx.DB) (string, error) {
+	query, ok := roleQueries[dialect(c.driver)]
+	if !ok {
+		return "", fmt.Errorf("role detection is not supported for driver %q", c.driver)
+	}
+	var replica bool
+	if err := conn.Get(&replica, query); err != nil {
+		c.setRole("")
+		return "", err
+	}
+	if replica {
+		return c.setRole(roleReplica), nil
+	}
+	return c.setRole(rolePrimary), nil
+}
+
+func (c *connection) setRole(role string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.role
+	c.role = role
+	return prev
+}
+
+// serverRole returns the detected role of the server, empty if unknown
+func (c *connection) serverRole() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.role
+}
+
+// runsOnRole reports whether q runs on a server of the role. Queries limited
+// to a role are skipped while the role is unknown.
+func (q *Query) runsOnRole(role string) bool {
+	return q.RunOn == "" || q.RunOn == roleAny || q.RunOn == role
+}
+
+// roleProblem reports a query of the job that is limited to a role the
+// driver can't detect, and so would never run, empty if there is none
+func (j *Job) roleProblem(driver string) string {
+	if _, ok := roleQueries[dialect(driver)]; ok {
+		return ""
+	}
+	for _, q := range j.Queries {
+		if q == nil || !q.runsOn(&connection{driver: driver}) {
+			continue
+		}
+		if q.RunOn == rolePrimary || q.RunOn == roleReplica {
+			return fmt.Sprintf("query %q runs on %s servers, but the role is not detected for driver %q", q.Name, q.RunOn, driver)
+		}
+	}
+	return ""
+}
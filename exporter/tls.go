@@ -0,0 +1,296 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx"
+)
+
+// TLSConfig configures TLS and client certificates of database connections.
+// Each driver takes it in its own way, see connection.openTLS.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`              // CA certificates to verify the server with, the system roots if empty
+	CertFile           string `yaml:"cert_file,omitempty"`            // client certificate
+	KeyFile            string `yaml:"key_file,omitempty"`             // key of the client certificate
+	ServerName         string `yaml:"server_name,omitempty"`          // name to verify the server certificate with, the host if empty
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"` // don't verify the server certificate
+}
+
+// resolve makes the relative file paths relative to dir
+func (t *TLSConfig) resolve(dir string) {
+	for _, f := range []*string{&t.CAFile, &t.CertFile, &t.KeyFile} {
+		if *f != "" && !filepath.IsAbs(*f) {
+			*f = filepath.Join(dir, *f)
+		}
+	}
+}
+
+// check reports the problems of the config regardless of the driver
+func (t *TLSConfig) check() []string {
+	var problems []string
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		problems = append(problems, "cert_file and key_file must be set together")
+	}
+	for _, f := range []string{t.CAFile, t.CertFile, t.KeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// checkDriver reports the options the driver can't take
+func (t *TLSConfig) checkDriver(driver string) string {
+	switch dialect(driver) {
+	case "postgres":
+		if driver == "postgres" && t.ServerName != "" {
+			return "server_name is not supported by lib/pq, use pgx:// instead"
+		}
+	case "sqlserver", "mssql":
+		if t.CertFile != "" {
+			return fmt.Sprintf("client certificates are not supported for driver %q", driver)
+		}
+	case "mysql", "clickhouse":
+	default:
+		return fmt.Sprintf("tls is not supported for driver %q", driver)
+	}
+	return ""
+}
+
+// tlsFiles holds the certificates of a TLSConfig and reloads them once the
+// files change, so that rotated certificates are used without a restart
+type tlsFiles struct {
+	cfg      *TLSConfig
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+	roots    *x509.CertPool
+	cert     *tls.Certificate
+}
+
+// load reads the files again if any of them changed
+func (f *tlsFiles) load() (*x509.CertPool, *tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed := f.modTimes == nil
+	modTimes := make(map[string]time.Time, 3)
+	for _, name := range []string{f.cfg.CAFile, f.cfg.CertFile, f.cfg.KeyFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		modTimes[name] = fi.ModTime()
+		changed = changed || !fi.ModTime().Equal(f.modTimes[name])
+	}
+	if !changed {
+		return f.roots, f.cert, nil
+	}
+	var roots *x509.CertPool
+	if f.cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(f.cfg.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", f.cfg.CAFile)
+		}
+	}
+	var cert *tls.Certificate
+	if f.cfg.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(f.cfg.CertFile, f.cfg.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert = &c
+	}
+	f.roots, f.cert, f.modTimes = roots, cert, modTimes
+	return roots, cert, nil
+}
+
+// tlsConfig returns a tls.Config for the host that verifies the server and
+// presents the client certificate with the current contents of the files.
+// Without host the name is taken from the address dialed.
+func (t *TLSConfig) tlsConfig(files *tlsFiles, host string) *tls.Config {
+	serverName := t.ServerName
+	if serverName == "" && host != "" {
+		serverName = host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			serverName = h
+		}
+	}
+	return &tls.Config{
+		ServerName: serverName,
+		// the server is verified in VerifyConnection with the reloaded CA
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if t.InsecureSkipVerify {
+				return nil
+			}
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			roots, _, err := files.load()
+			if err != nil {
+				return err
+			}
+			intermediates := x509.NewCertPool()
+			for _, c := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(c)
+			}
+			name := serverName
+			if name == "" {
+				name = cs.ServerName
+			}
+			_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       name,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_, cert, err := files.load()
+			if err != nil {
+				return nil, err
+			}
+			if cert == nil {
+				// no client certificate configured
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+}
+
+// openTLS opens the connection with the TLS config
+func (c *connection) openTLS(dsn string, t *TLSConfig) (*sqlx.DB, error) {
+	files := &tlsFiles{cfg: t}
+	if _, _, err := files.load(); err != nil {
+		return nil, err
+	}
+	switch c.driver {
+	case "postgres":
+		// lib/pq reads the files on every connect
+		dsn, err := t.libpqDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return sqlx.Connect(c.driver, dsn)
+	case "sqlserver", "mssql":
+		// go-mssqldb reads the CA file on every connect
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("encrypt", "true")
+		q.Set("TrustServerCertificate", fmt.Sprint(t.InsecureSkipVerify))
+		setParam(q, "certificate", t.CAFile)
+		setParam(q, "hostNameInCertificate", t.ServerName)
+		u.RawQuery = q.Encode()
+		return sqlx.Connect(c.driver, u.String())
+	case "pgx":
+		cfg, err := pgx.ParseConfig(dsn)
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLSConfig = t.tlsConfig(files, cfg.Host)
+		for _, fb := range cfg.Fallbacks {
+			fb.TLSConfig = t.tlsConfig(files, fb.Host)
+		}
+		return pingDB(sqlx.NewDb(stdlib.OpenDB(*cfg), c.driver))
+	case "mysql":
+		// the driver looks the config up by the name in the DSN
+		name := fmt.Sprintf("sql_exporter_%p", c)
+		if err := mysql.RegisterTLSConfig(name, t.tlsConfig(files, c.url.Hostname())); err != nil {
+			return nil, err
+		}
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		db, err := sqlx.Connect(c.driver, dsn+sep+"tls="+url.QueryEscape(name))
+		if err != nil {
+			mysql.DeregisterTLSConfig(name)
+			return nil, err
+		}
+		// deregistered by close
+		c.tlsName = name
+		return db, nil
+	case "clickhouse":
+		opt, err := clickhouse.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		// the driver dials every host of a cluster with its own name
+		opt.TLS = t.tlsConfig(files, "")
+		return pingDB(sqlx.NewDb(clickhouse.OpenDB(opt), c.driver))
+	}
+	return nil, fmt.Errorf("tls is not supported for driver %q", c.driver)
+}
+
+// releaseTLS deregisters the TLS config of a mysql connection, the driver
+// keeps it until then
+func (c *connection) releaseTLS() {
+	if c.tlsName != "" {
+		mysql.DeregisterTLSConfig(c.tlsName)
+		c.tlsName = ""
+	}
+}
+
+// libpqDSN adds the TLS options to the lib/pq URL dsn. sslmode require
+// verifies the server with sslrootcert if set, so it's left out if the
+// server isn't to be verified.
+func (t *TLSConfig) libpqDSN(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("sslmode", "verify-full")
+	if t.InsecureSkipVerify {
+		q.Set("sslmode", "require")
+	} else {
+		setParam(q, "sslrootcert", t.CAFile)
+	}
+	setParam(q, "sslcert", t.CertFile)
+	setParam(q, "sslkey", t.KeyFile)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// setParam sets the URL parameter if the value isn't empty
+func setParam(q url.Values, key, value string) {
+	if value != "" {
+		q.Set(key, value)
+	}
+}
+
+// pingDB verifies the connection like sqlx.Connect
+func pingDB(db *sqlx.DB) (*sqlx.DB, error) {
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
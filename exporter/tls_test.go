@@ -0,0 +1,66 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestLibpqDSN(t *testing.T) {
+	for _, tc := range []struct {
+		tls  TLSConfig
+		want string
+	}{
+		{TLSConfig{}, "sslmode=verify-full"},
+		{TLSConfig{CAFile: "/ca.pem"}, "sslmode=verify-full&sslrootcert=%2Fca.pem"},
+		// sslrootcert would make lib/pq verify the server
+		{TLSConfig{CAFile: "/ca.pem", InsecureSkipVerify: true}, "sslmode=require"},
+		{TLSConfig{CertFile: "/c.pem", KeyFile: "/k.pem"}, "sslcert=%2Fc.pem&sslkey=%2Fk.pem&sslmode=verify-full"},
+	} {
+		dsn, err := tc.tls.libpqDSN("postgres://user@host/db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "postgres://user@host/db?" + tc.want; dsn != want {
+			t.Errorf("got %s, want %s", dsn, want)
+		}
+	}
+}
+
+func TestMySQLTLSRegistration(t *testing.T) {
+	// the driver refuses DSNs with TLS configs that aren't registered
+	registered := func(name string) bool {
+		_, err := mysql.ParseDSN("user@tcp(127.0.0.1:1)/db?tls=" + url.QueryEscape(name))
+		return err == nil
+	}
+	c, err := (&Connection{Driver: "mysql", Host: "127.0.0.1", Port: 1, User: "user", Database: "db"}).newConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn, err := c.dsn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.openTLS(dsn, &TLSConfig{InsecureSkipVerify: true}); err == nil {
+		t.Fatal("connected to a closed port")
+	}
+	if name := fmt.Sprintf("sql_exporter_%p", c); c.tlsName != "" || registered(name) {
+		t.Fatalf("TLS config %q of a failed connection is registered", name)
+	}
+
+	// e.g. a connection that was retired
+	c.tlsName = "sql_exporter_test"
+	if err := mysql.RegisterTLSConfig(c.tlsName, &tls.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if !registered(c.tlsName) {
+		t.Fatal("TLS config isn't registered")
+	}
+	c.close()
+	if registered("sql_exporter_test") {
+		t.Fatal("TLS config is registered after close")
+	}
+}
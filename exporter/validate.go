@@ -0,0 +1,475 @@
+package exporter
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// source is a parsed config file. It maps the path of every node (e.g.
+// "jobs[0].queries[1].query_ref") to its line for error reporting.
+type source struct {
+	file  string
+	lines map[string]int
+}
+
+func newSource(file string, root *yaml.Node) *source {
+	s := &source{
+		file:  file,
+		lines: make(map[string]int),
+	}
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		s.index(root.Content[0], "")
+	}
+	return s
+}
+
+// index records the lines of n and all of its children
+func (s *source) index(n *yaml.Node, path string) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := n.Content[i].Value
+			if path != "" {
+				p = path + "." + p
+			}
+			s.lines[p] = n.Content[i].Line
+			s.index(n.Content[i+1], p)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			s.lines[p] = c.Line
+			s.index(c, p)
+		}
+	}
+}
+
+// at returns the position of the node at path, or of its closest known parent
+func (s *source) at(path string) string {
+	if s == nil {
+		return ""
+	}
+	for p := path; p != ""; {
+		if line, ok := s.lines[p]; ok {
+			return fmt.Sprintf("%s:%d", s.file, line)
+		}
+		i := strings.LastIndexAny(p, ".[")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	return s.file
+}
+
+// at returns the position of a node of the job, e.g. "interval"
+func (j *Job) at(path string) string {
+	if path == "" {
+		return j.src.at(j.path)
+	}
+	if !strings.HasPrefix(path, "[") {
+		path = "." + path
+	}
+	return j.src.at(j.path + path)
+}
+
+// ConfigError is a single problem found in a config file
+type ConfigError struct {
+	Pos string
+	Msg string
+}
+
+func (e ConfigError) Error() string {
+	if e.Pos == "" {
+		return e.Msg
+	}
+	return e.Pos + ": " + e.Msg
+}
+
+// ConfigErrors collects all problems found in a config file so that they can
+// be reported at once
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d problem(s) in config:\n\t%s", len(e), strings.Join(msgs, "\n\t"))
+}
+
+func (e *ConfigErrors) add(pos string, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// typeErrors converts the errors of a strict decoding pass, e.g. unknown
+// fields, to config errors
+func (e *ConfigErrors) typeErrors(file string, err *yaml.TypeError) {
+	for _, msg := range err.Errors {
+		// messages look like "line 12: field lables not found in type ..."
+		var line int
+		if _, scanErr := fmt.Sscanf(msg, "line %d:", &line); scanErr == nil {
+			msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+			e.add(fmt.Sprintf("%s:%d", file, line), "%s", msg)
+			continue
+		}
+		e.add(file, "%s", msg)
+	}
+}
+
+// labelNameRE matches valid label names, see
+// github.com/prometheus/common/model.LabelNameRE
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// validate checks the semantics of the config, adding every problem to errs
+func (f *File) validate(errs *ConfigErrors) {
+	// connections use their URL scheme as driver name
+	drivers := sql.Drivers()
+	known := make(map[string]bool, len(drivers))
+	for _, d := range drivers {
+		known[d] = true
+	}
+
+	jobs := make(map[string]*Job, len(f.Jobs))
+	for _, j := range f.Jobs {
+		if j == nil {
+			// reported while reading the file
+			continue
+		}
+		if j.Name == "" {
+			errs.add(j.at(""), "job has no name")
+		} else if prev, ok := jobs[j.Name]; ok {
+			errs.add(j.at("name"), "job name %q is already used at %s", j.Name, prev.at("name"))
+		} else {
+			jobs[j.Name] = j
+		}
+		if j.Interval <= 0 {
+			errs.add(j.at("interval"), "job %q: interval must be positive", j.Name)
+		}
+		if j.ConnMaxLifetime < 0 {
+			errs.add(j.at("conn_max_lifetime"), "job %q: conn_max_lifetime must not be negative", j.Name)
+		}
+		if cb := j.CircuitBreaker; cb != nil {
+			if cb.Failures < 0 {
+				errs.add(j.at("circuit_breaker.failures"), "job %q: failures must not be negative", j.Name)
+			}
+			if cb.OpenDuration < 0 {
+				errs.add(j.at("circuit_breaker.open_duration"), "job %q: open_duration must not be negative", j.Name)
+			}
+			if cb.MaxOpenDuration < 0 {
+				errs.add(j.at("circuit_breaker.max_open_duration"), "job %q: max_open_duration must not be negative", j.Name)
+			} else if cb.MaxOpenDuration > 0 && cb.MaxOpenDuration < cb.openDuration(j.Interval) {
+				errs.add(j.at("circuit_breaker.max_open_duration"), "job %q: max_open_duration must not be shorter than open_duration", j.Name)
+			}
+		}
+		if len(j.Connections) == 0 && j.ConnectionsFrom == nil {
+			errs.add(j.at(""), "job %q has no connections", j.Name)
+		}
+		if sd := j.ConnectionsFrom; sd != nil {
+			if len(sd.Files) == 0 {
+				errs.add(j.at("connections_from"), "job %q: connections_from has no files", j.Name)
+			}
+			for k, pattern := range sd.Files {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					errs.add(j.at(fmt.Sprintf("connections_from.files[%d]", k)), "job %q: invalid pattern %q: %v", j.Name, pattern, err)
+				}
+			}
+			if sd.RefreshInterval < 0 {
+				errs.add(j.at("connections_from.refresh_interval"), "job %q: refresh_interval must not be negative", j.Name)
+			}
+			for k, label := range sd.Labels {
+				if !labelNameRE.MatchString(label) {
+					errs.add(j.at(fmt.Sprintf("connections_from.labels[%d]", k)), "job %q: invalid label name %q", j.Name, label)
+				}
+			}
+			if j.AutoDiscoverDatabases != nil {
+				errs.add(j.at("connections_from"), "job %q: connections_from and auto_discover_databases can't be combined", j.Name)
+			}
+		}
+		if j.TLS != nil {
+			for _, problem := range j.TLS.check() {
+				errs.add(j.at("tls"), "job %q: tls: %s", j.Name, problem)
+			}
+		}
+		for k := range j.Connections {
+			c := &j.Connections[k]
+			cpath := fmt.Sprintf("connections[%d]", k)
+			pos := j.at(cpath)
+			if c.URL != "" {
+				if c.Driver != "" || c.Host != "" || c.Port != 0 || c.Database != "" || c.User != "" || c.PasswordFile != "" || len(c.Params) > 0 {
+					errs.add(pos, "job %q: connection %d has both url and its parts", j.Name, k)
+				}
+				if _, err := url.Parse(c.URL); err != nil {
+					// the parse error contains the password, so leave it out
+					errs.add(pos, "job %q: connection %d is not a valid URL", j.Name, k)
+					continue
+				}
+			} else {
+				if c.Driver == "" {
+					errs.add(pos, "job %q: connection %d has neither url nor driver", j.Name, k)
+					continue
+				}
+				if c.Driver == "sqlite" && c.Database == "" {
+					errs.add(pos, "job %q: connection %d has no database", j.Name, k)
+				}
+				if c.Driver != "sqlite" && c.Host == "" {
+					errs.add(pos, "job %q: connection %d has no host", j.Name, k)
+				}
+				if c.Port < 0 || c.Port > 65535 {
+					errs.add(j.at(cpath+".port"), "job %q: connection %d has an invalid port %d", j.Name, k, c.Port)
+				}
+				if c.PasswordFile != "" {
+					if _, err := os.Stat(c.PasswordFile); err != nil {
+						errs.add(j.at(cpath+".password_file"), "job %q: connection %d: %v", j.Name, k, err)
+					}
+				}
+			}
+			for name := range c.Labels {
+				if !labelNameRE.MatchString(name) {
+					errs.add(j.at(cpath+".labels."+name), "job %q: invalid label name %q", j.Name, name)
+				}
+			}
+			driver := c.driver()
+			if !known[driver] {
+				errs.add(pos, "job %q: unknown driver %q in connection %d, known drivers are %s", j.Name, driver, k, strings.Join(drivers, ", "))
+				continue
+			}
+			if problem := j.roleProblem(driver); problem != "" {
+				errs.add(pos, "job %q: %s", j.Name, problem)
+			}
+			t := j.TLS
+			if c.TLS != nil {
+				t = c.TLS
+				for _, problem := range t.check() {
+					errs.add(j.at(cpath+".tls"), "job %q: tls: %s", j.Name, problem)
+				}
+			}
+			if t != nil {
+				if problem := t.checkDriver(driver); problem != "" {
+					errs.add(pos, "job %q: tls: %s", j.Name, problem)
+				}
+			}
+		}
+		if d := j.AutoDiscoverDatabases; d != nil {
+			if err := d.compile(); err != nil {
+				errs.add(j.at("auto_discover_databases"), "job %q: auto_discover_databases: %v", j.Name, err)
+			}
+			if d.RefreshInterval < 0 {
+				errs.add(j.at("auto_discover_databases.refresh_interval"), "job %q: refresh_interval must not be negative", j.Name)
+			}
+			for k := range j.Connections {
+				if driver := j.Connections[k].driver(); known[driver] && discoveryQueries[dialect(driver)] == "" {
+					errs.add(j.at(fmt.Sprintf("connections[%d]", k)), "job %q: auto_discover_databases is not supported for driver %q", j.Name, driver)
+				}
+			}
+		}
+		if d := j.DNSSD; d != nil {
+			if t := d.recordType(); t != "A" && t != "SRV" {
+				errs.add(j.at("dns_sd.type"), "job %q: dns_sd type must be A or SRV, not %q", j.Name, d.Type)
+			}
+			if d.RefreshInterval < 0 {
+				errs.add(j.at("dns_sd.refresh_interval"), "job %q: refresh_interval must not be negative", j.Name)
+			}
+			if j.AutoDiscoverDatabases != nil {
+				errs.add(j.at("dns_sd"), "job %q: dns_sd and auto_discover_databases can't be combined", j.Name)
+			}
+			for k, c := range j.Connections {
+				// the MySQL DSN wraps the host, e.g. tcp(host), connection
+				// objects don't
+				if c.URL != "" && c.driver() == "mysql" {
+					errs.add(j.at(fmt.Sprintf("connections[%d]", k)), "job %q: dns_sd is not supported for mysql URLs, use a connection object", j.Name)
+				}
+				t := j.TLS
+				if c.TLS != nil {
+					t = c.TLS
+				}
+				// lib/pq can't verify the address with another name
+				if t != nil && !t.InsecureSkipVerify && d.recordType() == "A" && c.driver() == "postgres" {
+					errs.add(j.at(fmt.Sprintf("connections[%d]", k)), "job %q: tls: lib/pq verifies the resolved addresses instead of the host name, use pgx:// instead", j.Name)
+				}
+			}
+		}
+		if len(j.Queries) == 0 {
+			errs.add(j.at(""), "job %q has no queries", j.Name)
+		}
+		queries := make(map[string]int, len(j.Queries))
+		for k, q := range j.Queries {
+			qpath := fmt.Sprintf("queries[%d]", k)
+			if q == nil {
+				errs.add(j.at(qpath), "job %q: query %d is empty", j.Name, k)
+				continue
+			}
+			if q.Name == "" {
+				errs.add(j.at(qpath), "job %q: query %d has no name", j.Name, k)
+			} else if prev, ok := queries[q.Name]; ok {
+				errs.add(j.at(qpath+".name"), "job %q: query name %q is already used at %s", j.Name, q.Name, j.at(fmt.Sprintf("queries[%d].name", prev)))
+			} else {
+				queries[q.Name] = k
+			}
+			if len(q.Values) == 0 {
+				errs.add(j.at(qpath), "job %q: query %q has no values", j.Name, q.Name)
+			}
+			for l, v := range q.Values {
+				if v == "" {
+					errs.add(j.at(fmt.Sprintf("%s.values[%d]", qpath, l)), "job %q: query %q has an empty value column", j.Name, q.Name)
+				}
+			}
+			for l, label := range q.Labels {
+				if label == "" {
+					errs.add(j.at(fmt.Sprintf("%s.labels[%d]", qpath, l)), "job %q: query %q has an empty label column", j.Name, q.Name)
+				}
+			}
+			// references to the library are checked while resolving them
+			if j.readOnly() {
+				if err := checkReadOnly(q.Query, q.AllowProcedures); err != nil {
+					errs.add(j.at(qpath+".query"), "job %q: query %q: %v, unless read_only is false", j.Name, q.Name, err)
+				}
+			}
+			for l, name := range q.AllowProcedures {
+				if p, end := procedureName(name, 0); p == "" || strings.TrimSpace(name[end:]) != "" {
+					errs.add(j.at(fmt.Sprintf("%s.allow_procedures[%d]", qpath, l)), "job %q: query %q: %q is not a procedure name", j.Name, q.Name, name)
+				}
+			}
+			for l, stmt := range q.PreSQL {
+				lpath := fmt.Sprintf("%s.pre_sql[%d]", qpath, l)
+				if strings.TrimSpace(stmt) == "" {
+					errs.add(j.at(lpath), "job %q: query %q has an empty pre_sql statement", j.Name, q.Name)
+				} else if j.readOnly() {
+					if err := checkPreSQL(stmt, q.AllowProcedures); err != nil {
+						errs.add(j.at(lpath), "job %q: query %q: pre_sql: %v, unless read_only is false", j.Name, q.Name, err)
+					}
+				}
+				if !setsLocal(stmt) {
+					continue
+				}
+				// without a transaction the setting stays on the pooled
+				// connection
+				if !j.readOnly() {
+					errs.add(j.at(lpath), "job %q: query %q: pre_sql: SET LOCAL needs the transaction of read_only", j.Name, q.Name)
+					continue
+				}
+				reported := make(map[string]bool)
+				for k := range j.Connections {
+					driver := j.Connections[k].driver()
+					if known[driver] && !reported[driver] && q.runsOn(&connection{driver: driver}) && dialect(driver) != "postgres" {
+						errs.add(j.at(lpath), "job %q: query %q: pre_sql: SET LOCAL is not supported for driver %q", j.Name, q.Name, driver)
+						reported[driver] = true
+					}
+				}
+			}
+			for l, rs := range q.ResultSets {
+				if rs == nil {
+					continue
+				}
+				rpath := fmt.Sprintf("%s.result_sets[%d]", qpath, l)
+				labels := make(map[string]bool, len(q.Labels))
+				for _, name := range q.Labels {
+					labels[name] = true
+				}
+				values := make(map[string]bool, len(q.Values))
+				for _, name := range q.Values {
+					values[name] = true
+				}
+				for name := range rs.Labels {
+					if !labels[name] {
+						errs.add(j.at(rpath+".labels."+name), "job %q: query %q: result set %d maps %q, which is not a label of the query", j.Name, q.Name, l, name)
+					}
+				}
+				for name := range rs.Values {
+					if !values[name] {
+						errs.add(j.at(rpath+".values."+name), "job %q: query %q: result set %d maps %q, which is not a value of the query", j.Name, q.Name, l, name)
+					}
+				}
+			}
+			if len(q.ResultSets) > 0 && q.Incremental != nil {
+				errs.add(j.at(qpath+".result_sets"), "job %q: query %q: incremental queries read a single result set", j.Name, q.Name)
+			}
+			watermarkArg := false
+			for l := range q.Args {
+				if problem := q.Args[l].check(); problem != "" {
+					errs.add(j.at(fmt.Sprintf("%s.args[%d]", qpath, l)), "job %q: query %q: argument %d: %s", j.Name, q.Name, l, problem)
+				}
+				if q.Args[l].Runtime == argWatermark {
+					watermarkArg = true
+					if q.Incremental == nil {
+						errs.add(j.at(fmt.Sprintf("%s.args[%d]", qpath, l)), "job %q: query %q: argument %d: the watermark is only known for incremental queries", j.Name, q.Name, l)
+					}
+				}
+			}
+			if inc := q.Incremental; inc != nil {
+				if inc.Watermark == "" {
+					errs.add(j.at(qpath+".incremental"), "job %q: query %q: incremental queries need a watermark column", j.Name, q.Name)
+				}
+				for _, column := range append(append([]string{}, q.Labels...), q.Values...) {
+					if column != "" && column == inc.Watermark {
+						errs.add(j.at(qpath+".incremental.watermark"), "job %q: query %q: the watermark column %q must not be a label or value", j.Name, q.Name, column)
+					}
+				}
+				sqls := []string{q.Query}
+				for _, v := range q.Variants {
+					sqls = append(sqls, v.Query)
+				}
+				for _, sql := range sqls {
+					if sql != "" && inc.Watermark != "" && !selectsColumn(sql, inc.Watermark) {
+						errs.add(j.at(qpath+".incremental.watermark"), "job %q: query %q: the watermark column %q is not selected by the query", j.Name, q.Name, inc.Watermark)
+						break
+					}
+				}
+				if !watermarkArg {
+					errs.add(j.at(qpath+".incremental"), "job %q: query %q: incremental queries must select the rows after the watermark, bound as an argument with runtime watermark", j.Name, q.Name)
+				}
+			}
+			if q.Query == "" && q.QueryRef == "" && q.Use == "" && len(q.Variants) == 0 {
+				errs.add(j.at(qpath), "job %q: query %q has neither query, query_ref, use nor variants", j.Name, q.Name)
+			}
+			if _, err := parseVersion(q.MinVersion); q.MinVersion != "" && err != nil {
+				errs.add(j.at(qpath+".min_version"), "job %q: query %q: %v", j.Name, q.Name, err)
+			}
+			if _, err := parseVersion(q.MaxVersion); q.MaxVersion != "" && err != nil {
+				errs.add(j.at(qpath+".max_version"), "job %q: query %q: %v", j.Name, q.Name, err)
+			}
+			switch q.Type {
+			case "", typeGauge, typeCounter, typeUntyped:
+				if q.Incremental != nil && q.Type != "" && q.Type != typeCounter {
+					errs.add(j.at(qpath+".type"), "job %q: query %q: incremental queries are counters, not %ss", j.Name, q.Name, q.Type)
+				}
+			default:
+				errs.add(j.at(qpath+".type"), "job %q: query %q: type must be gauge, counter or untyped, not %q", j.Name, q.Name, q.Type)
+			}
+			if q.MinInterval < 0 {
+				errs.add(j.at(qpath+".min_interval"), "job %q: query %q: min_interval must not be negative", j.Name, q.Name)
+			}
+			switch q.RunOn {
+			case "", rolePrimary, roleReplica, roleAny:
+			default:
+				errs.add(j.at(qpath+".run_on"), "job %q: query %q: run_on must be primary, replica or any, not %q", j.Name, q.Name, q.RunOn)
+			}
+			for l, v := range q.Variants {
+				vpath := fmt.Sprintf("%s.variants[%d]", qpath, l)
+				if v.Driver != "" && !known[v.Driver] {
+					errs.add(j.at(vpath+".driver"), "job %q: query %q: unknown driver %q", j.Name, q.Name, v.Driver)
+				}
+				if _, err := parseVersion(v.MinVersion); v.MinVersion != "" && err != nil {
+					errs.add(j.at(vpath+".min_version"), "job %q: query %q: %v", j.Name, q.Name, err)
+				}
+				if _, err := parseVersion(v.MaxVersion); v.MaxVersion != "" && err != nil {
+					errs.add(j.at(vpath+".max_version"), "job %q: query %q: %v", j.Name, q.Name, err)
+				}
+				if v.Query == "" {
+					errs.add(j.at(vpath), "job %q: query %q has a variant without query", j.Name, q.Name)
+				} else if j.readOnly() {
+					if err := checkReadOnly(v.Query, q.AllowProcedures); err != nil {
+						errs.add(j.at(vpath+".query"), "job %q: query %q: %v, unless read_only is false", j.Name, q.Name, err)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+)
+
+// checkConfig reads config and fails unless the problems reported contain
+// all of want, or there are none if want is empty
+func checkConfig(t *testing.T, config string, want ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	_, err := Read(writeTestConfig(t, dir, config))
+	if len(want) == 0 {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("no problems reported, want %q", want)
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("problems don't contain %q:\n%v", w, err)
+		}
+	}
+}
+
+func TestValidateQueryType(t *testing.T) {
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - {name: g, help: h, values: [v], query: 'SELECT 1', type: gauge}
+  - {name: c, help: h, values: [v], query: 'SELECT 1', type: counter}
+  - {name: u, help: h, values: [v], query: 'SELECT 1', type: untyped}
+`)
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - {name: s, help: h, values: [v], query: 'SELECT 1', type: summary}
+  - name: i
+    help: h
+    values: [v]
+    query: 'SELECT count(*) AS v, max(id) AS id FROM t WHERE id > ?'
+    args: [{runtime: watermark}]
+    incremental: {watermark: id}
+    type: gauge
+`,
+		`c.yml:7: job "a": query "s": type must be gauge, counter or untyped, not "summary"`,
+		`c.yml:14: job "a": query "i": incremental queries are counters, not gauges`,
+	)
+}
+
+func TestValidateIncremental(t *testing.T) {
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - name: i
+    help: h
+    values: [v]
+    query: 'SELECT count(*) AS v, max(id) AS ID FROM t WHERE id > ?'
+    args: [{runtime: watermark}]
+    incremental: {watermark: id}
+`)
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlite://DIR/x.db']
+  queries:
+  - name: i
+    help: h
+    values: [v]
+    query: 'SELECT count(*) AS v, max(id) AS id FROM t WHERE id > ?'
+    args: [{runtime: watermark}]
+    incremental: {watermark: last_id}
+  - name: j
+    help: h
+    labels: [id]
+    values: [v]
+    query: 'SELECT count(*) AS v, id FROM t WHERE id > ? GROUP BY id'
+    args: [{runtime: watermark}]
+    incremental: {watermark: id}
+`,
+		`c.yml:12: job "a": query "i": the watermark column "last_id" is not selected by the query`,
+		`c.yml:19: job "a": query "j": the watermark column "id" must not be a label or value`,
+	)
+}
+
+func TestValidateRunOn(t *testing.T) {
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@host/db', 'sqlite://DIR/x.db']
+  queries:
+  - {name: p, help: h, values: [v], query: 'SELECT 1', run_on: any}
+  - name: r
+    help: h
+    values: [v]
+    query: 'SELECT 1'
+    run_on: replica
+    variants: [{driver: postgres, query: 'SELECT 2'}]
+`, `c.yml:5: job "a": query "r" runs on replica servers, but the role is not detected for driver "sqlite"`)
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@host/db']
+  queries:
+  - {name: p, help: h, values: [v], query: 'SELECT 1', run_on: primary}
+`)
+}
+
+func TestValidatePreSQL(t *testing.T) {
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@host/db']
+  queries:
+  - name: q
+    help: h
+    values: [v]
+    query: SELECT 1 AS v
+    pre_sql: ["SET LOCAL statement_timeout = '5s'", "SET search_path = x"]
+`)
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['postgres://user@host/db', 'mysql://user@tcp(host)/db', 'mysql://user@tcp(other)/db']
+  queries:
+  - name: q
+    help: h
+    values: [v]
+    query: SELECT 1 AS v
+    pre_sql: ['', "EXEC sp_set_session_context 'k', 'v'", 'SET LOCAL sql_mode = ""']
+- name: b
+  interval: 1m
+  read_only: false
+  connections: ['postgres://user@host/db']
+  queries:
+  - {name: q, help: h, values: [v], query: SELECT 1 AS v, pre_sql: ["SET LOCAL work_mem = '64MB'"]}
+`,
+		`c.yml:11: job "a": query "q" has an empty pre_sql statement`,
+		`c.yml:11: job "a": query "q": pre_sql: EXEC sp_set_session_context is not allowed in read-only mode, unless read_only is false`,
+		`c.yml:11: job "a": query "q": pre_sql: SET LOCAL is not supported for driver "mysql"`,
+		`c.yml:17: job "b": query "q": pre_sql: SET LOCAL needs the transaction of read_only`,
+	)
+	checkConfig(t, `
+jobs:
+- name: a
+  interval: 1m
+  connections: ['sqlserver://user@host/db']
+  queries:
+  - name: q
+    help: h
+    values: [v]
+    query: EXEC dbo.collect_diagnostics
+    pre_sql: ["EXEC sp_set_session_context 'k', 'v'"]
+    allow_procedures: [dbo.collect_diagnostics, sp_set_session_context]
+  - {name: r, help: h, values: [v], query: EXEC dbo.p, allow_procedures: ['dbo.p x']}
+`,
+		`c.yml:13: job "a": query "r": "dbo.p x" is not a procedure name`,
+	)
+}
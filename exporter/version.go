@@ -0,0 +1,128 @@
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// versionQueries return the server version for each driver
+var versionQueries = map[string]string{
+	"postgres":   "SHOW server_version",
+	"mysql":      "SELECT VERSION()",
+	"sqlserver":  "SELECT CAST(SERVERPROPERTY('ProductVersion') AS NVARCHAR(128))",
+	"mssql":      "SELECT CAST(SERVERPROPERTY('ProductVersion') AS NVARCHAR(128))",
+	"clickhouse": "SELECT version()",
+	"sqlite":     "SELECT sqlite_version()",
+}
+
+// serverVersion is a dotted numeric version, e.g. 9.6.24
+type serverVersion []int
+
+// parseVersion parses the leading dotted numbers of s, so that suffixes like
+// in "14.5 (Debian 14.5-1.pgdg110+1)" or "8.0.32-log" are ignored
+func parseVersion(s string) (serverVersion, error) {
+	s = strings.TrimSpace(s)
+	var v serverVersion
+	for _, part := range strings.Split(s, ".") {
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		n, err := strconv.Atoi(part[:end])
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, n)
+		if end < len(part) {
+			break
+		}
+	}
+	if len(v) == 0 {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 if v is lower, equal or greater than o. Missing
+// parts count as zero, so 10 equals 10.0.
+func (v serverVersion) compare(o serverVersion) int {
+	for i := 0; i < len(v) || i < len(o); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(o) {
+			b = o[i]
+		}
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+	return 0
+}
+
+// within reports whether v is in the range [min, max). Empty bounds are
+// open, an unknown version is only within an unbounded range.
+func (v serverVersion) within(min, max string) bool {
+	if min == "" && max == "" {
+		return true
+	}
+	if v == nil {
+		return false
+	}
+	if min != "" {
+		if m, err := parseVersion(min); err != nil || v.compare(m) < 0 {
+			return false
+		}
+	}
+	if max != "" {
+		if m, err := parseVersion(max); err != nil || v.compare(m) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (v serverVersion) String() string {
+	parts := make([]string, 0, len(v))
+	for _, n := range v {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, ".")
+}
+
+// detectVersion queries the server version of a new connection
+func (c *connection) detectVersion(conn *sqlx.DB) error {
+	query, ok := versionQueries[dialect(c.driver)]
+	if !ok {
+		return fmt.Errorf("version detection is not supported for driver %q", c.driver)
+	}
+	var raw string
+	if err := conn.Get(&raw, query); err != nil {
+		return err
+	}
+	v, err := parseVersion(raw)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.version = v
+	c.mu.Unlock()
+	return nil
+}
+
+// serverVersion returns the detected version of the server, nil if unknown
+func (c *connection) serverVersion() serverVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}